@@ -1,24 +1,22 @@
 package urknall
 
 import (
-	"archive/tar"
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
-	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
 
 	"github.com/dynport/dgtk/confirm"
-	"github.com/dynport/gocli"
+	"github.com/dynport/urknall/cmd"
 	"github.com/dynport/urknall/pubsub"
 	"github.com/dynport/urknall/target"
 )
@@ -32,6 +30,16 @@ func Run(target Target, tpl Template, opts ...func(*Build)) (e error) {
 	return b.Run()
 }
 
+// A shortcut creating and running a build from the given target and template
+// using the given context. The build is aborted if the context is cancelled.
+func RunContext(ctx context.Context, target Target, tpl Template, opts ...func(*Build)) (e error) {
+	b := &Build{Target: target, Template: tpl}
+	for _, o := range opts {
+		o(b)
+	}
+	return b.RunContext(ctx)
+}
+
 // A shortcut creating and runnign a build from the given target and template
 // with the DryRun flag set to true. This is quite helpful to actually see
 // which commands would be exeucted in the current setting, without actually
@@ -40,6 +48,16 @@ func DryRun(target Target, tpl Template) (e error) {
 	return (&Build{Target: target, Template: tpl}).DryRun()
 }
 
+// A shortcut removing the state of all tasks from the target, that the given
+// template doesn't produce anymore (see Build.Prune).
+func Prune(target Target, tpl Template, opts ...func(*Build)) ([]string, error) {
+	b := &Build{Target: target, Template: tpl}
+	for _, o := range opts {
+		o(b)
+	}
+	return b.Prune()
+}
+
 // A build is the glue between a target and template.
 type Build struct {
 	Target            // Where to run the build.
@@ -47,385 +65,404 @@ type Build struct {
 	Env      []string // Environment variables in the form `KEY=VALUE`.
 	Confirm  func(actions ...*confirm.Action) error
 
-	maxLength int // length of the longest key to be executed
+	// Timeout for commands not implementing the cmd.Timeouter interface. No
+	// timeout is used if not set. Timeouts require the target's commands to
+	// implement the target.Killer interface, builds fail otherwise. Cancelling
+	// the build's context waits for commands that can't be killed to finish.
+	CommandTimeout time.Duration
+
+	// How the build's plan is carried out. The pending commands are run on the
+	// target if not set.
+	Executor Executor
+
+	// Where the state of executed commands is kept. If not set, targets
+	// implementing the StateStore interface themselves are used, the state is
+	// stored on the target otherwise.
+	State StateStore
+
+	// Where the build's messages are published. The default events (used by
+	// loggers opened with OpenLogger) are used if not set.
+	Events *pubsub.Events
+
+	// Environment variables with secret values. They are masked like the
+	// build's Secrets without being added there.
+	SecretEnv map[string]Secret
+
+	// Values masked in all output of the build and in the state kept on the
+	// target. Secret fields of templates and the values of SecretEnv are masked
+	// without being added here.
+	Secrets []Secret
+
+	runID    string                       // identifier of the current run
+	executed map[*TaskPlan][]*CommandPlan // commands executed in the current run (for rollbacks)
+	secrets  secrets                      // secrets of the current plan
+	pkg      *packageImpl                 // the rendered template (shared by the builds of a multi build)
 }
 
 // This will render the build's template into a package and run all its tasks.
 func (b *Build) Run() error {
-	i, err := renderTemplate(b.Template)
-	if err != nil {
-		return err
-	}
-	m, err := readState(b.Target)
-	if err != nil {
-		return err
+	return b.RunContext(context.Background())
+}
+
+// Like Run, but the build is aborted as soon as the given context is done. The
+// currently running command is killed on the target and marked as failed.
+func (b *Build) RunContext(ctx context.Context) error {
+	ex := b.Executor
+	if ex == nil {
+		ex = &RunExecutor{}
 	}
-	actions := confirm.Actions{}
+	return b.execute(ctx, ex, true)
+}
 
-	for _, t := range i.tasks {
-		ex := []string{}
-		if s, ok := m[t.name]; ok {
-			ex = s.runSHAs
-		}
+// Publish the commands that would be executed or are cached, without actually
+// running anything on the target.
+func (b *Build) DryRun() error {
+	return b.execute(context.Background(), &DryRunExecutor{}, false)
+}
 
-		diff := []string{}
-		checksums := []string{}
-		broken := false
-		for i, c := range t.commands {
-			cs := c.Checksum()
-			checksums = append(checksums, "/var/lib/urknall/"+t.name+"/"+cs+".done")
-			if broken || len(ex) <= i || ex[i] != cs {
-				diff = append(diff, cs)
-				broken = true
-
-				var pl []byte
-				_, cmd, ok, err := extractWriteFile(c.command.Shell())
-				if err == nil && ok {
-					pl = []byte(cmd)
-				}
-				if len(t.name) > b.maxLength {
-					b.maxLength = len(t.name)
-				}
-				actions.Create(t.name+" "+c.LogMsg(), pl, b.commandAction(t.name, checksums, c))
-			}
-		}
+// Remove the state of all tasks from the target that are not part of the
+// build's template anymore. The names of the removed tasks are returned.
+func (b *Build) Prune() ([]string, error) {
+	p, err := b.Plan()
+	if err != nil {
+		return nil, err
 	}
-
-	if b.Confirm != nil {
-		if err := b.Confirm(actions...); err != nil {
-			return err
+	removed := []string{}
+	for _, t := range p.Tasks {
+		if !t.Orphaned {
+			continue
 		}
-	} else {
-		for _, a := range actions {
-			if err := a.Call(); err != nil {
-				return err
-			}
+		if err := b.stateStore().Remove(b.Target, t.Name); err != nil {
+			return removed, err
 		}
+		removed = append(removed, t.Name)
 	}
-	return nil
+	if len(removed) > 0 {
+		m := b.message(pubsub.MessageCleanupCacheEntries, "")
+		m.InvalidatedCacheEntries = removed
+		m.Publish("finished")
+	}
+	return removed, nil
 }
 
-func (b *Build) DryRun() error {
-	pkg, e := b.prepareBuild()
-	if e != nil {
-		return e
-	}
-
-	for _, task := range pkg.tasks {
-		for _, command := range task.commands {
-			m := message(pubsub.MessageTasksProvisionTask, b.hostname(), task.name)
-			m.TaskChecksum = command.Checksum()
-			m.Message = command.LogMsg()
-
-			switch {
-			case command.cached:
-				m.ExecStatus = pubsub.StatusCached
-				m.Publish("finished")
-			default:
-				m.ExecStatus = pubsub.StatusExecStart
-				m.Publish("executed")
-			}
-		}
+// The target is prepared (see StatePreparer) for builds running commands.
+func (b *Build) execute(ctx context.Context, ex Executor, prepare bool) error {
+	b.runID = newRunID(time.Now())
+	b.executed = nil
+	m := b.message(pubsub.MessageBuild, "")
+	m.Publish("started")
+	err := b.prepare(prepare)
+	if err == nil {
+		err = b.executePlan(ctx, ex)
 	}
+	m.TotalRuntime = time.Since(m.StartedAt)
+	if err != nil {
+		m.PublishError(err)
+		return err
+	}
+	m.Publish("finished")
 	return nil
 }
 
-func (build *Build) prepareBuild() (*packageImpl, error) {
-	pkg, e := renderTemplate(build.Template)
-	if e != nil {
-		return nil, e
+func (b *Build) prepare(prepare bool) error {
+	if p, ok := b.stateStore().(StatePreparer); ok && prepare {
+		return p.Prepare(b.Target, b.runID)
 	}
+	return nil
+}
 
-	if e = build.prepareTarget(); e != nil {
-		return nil, e
+func (b *Build) executePlan(ctx context.Context, ex Executor) error {
+	p, err := b.Plan()
+	if err != nil {
+		return err
 	}
-
-	ct, e := build.buildChecksumTree()
-	if e != nil {
-		return nil, fmt.Errorf("error building checksum tree: %s", e.Error())
+	if err := checkPlanUsers(b.Target, p); err != nil {
+		return err
 	}
-
-	return pkg, build.prepareTasks(ct, pkg.tasks...)
+	b.secrets = p.secrets
+	m := b.message(pubsub.MessageTasksProvision, "")
+	m.Message = fmt.Sprintf("%d tasks, %d commands pending", len(p.Tasks), p.Pending())
+	m.Publish("planned")
+	return ex.Execute(ctx, b, p)
 }
 
-func (build *Build) prepareTarget() error {
-	if build.User() == "" {
-		return fmt.Errorf("User not set")
-	}
-	rawCmd := fmt.Sprintf(`{ grep "^%s:" /etc/group | grep %s; } && [ -d %[3]s ] && [ -f %[3]s/.v2 ]`,
-		ukGROUP, build.User(), ukCACHEDIR)
-	cmd, e := build.prepareInternalCommand(rawCmd)
-	if e != nil {
-		return e
-	}
-	if e := cmd.Run(); e != nil {
-		// If user is missing the group, create group (if necessary), add user and restart ssh connection.
-		cmds := []string{
-			fmt.Sprintf(`{ grep -e '^%[1]s:' /etc/group > /dev/null || { groupadd %[1]s; }; }`, ukGROUP),
-			fmt.Sprintf(`{ [ -d %[1]s ] || { mkdir -p -m 2775 %[1]s && chgrp %[2]s %[1]s; }; }`, ukCACHEDIR, ukGROUP),
-			fmt.Sprintf("usermod -a -G %s %s", ukGROUP, build.User()),
-			fmt.Sprintf(`[ -f %[1]s/.v2 ] || { export DATE=$(date "+%%Y%%m%%d_%%H%%M%%S") && ls %[1]s | while read dir; do ls -t %[1]s/$dir/*.done | tac > %[1]s/$dir/$DATE.run; done && touch %[1]s/.v2;  } `, ukCACHEDIR),
-		}
-
-		cmd, e = build.prepareInternalCommand(strings.Join(cmds, " && "))
-		if e != nil {
-			return e
-		}
-		out := &bytes.Buffer{}
-		err := &bytes.Buffer{}
-		cmd.SetStderr(err)
-		cmd.SetStdout(out)
-		if e := cmd.Run(); e != nil {
-			return fmt.Errorf("failed to initiate user %q for provisioning: %s, out=%q err=%q", build.User(), e, out.String(), err.String())
-		}
-		return build.Reset()
-	}
-	return nil
+func (b *Build) stateStore() StateStore {
+	return stateStoreFor(b.Target, b.State)
 }
 
-func (build *Build) prepareTasks(ct checksumTree, tasks ...*task) error {
-	for _, task := range tasks {
-		if err := build.prepareTask(task, ct); err != nil {
-			return err
-		}
+func (build *Build) hostname() string {
+	if s, ok := build.Target.(fmt.Stringer); ok {
+		return s.String()
 	}
-	return nil
+	return "MISSING"
 }
 
-func (build *Build) prepareTask(tsk *task, ct checksumTree) (e error) {
-	cacheKey := tsk.name
-	if cacheKey == "" {
-		return fmt.Errorf("CacheKey must not be empty")
+// Run the given command of the task on the target. The execution is recorded
+// in the build's state store, including the command's output.
+func (b *Build) RunCommand(ctx context.Context, t *TaskPlan, c *CommandPlan) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	checksumDir := fmt.Sprintf(ukCACHEDIR+"/%s", tsk.name)
-
-	var found bool
-	var checksumList []string
-
-	if checksumList, found = ct[cacheKey]; !found {
-		// Create checksum dir and set group bit (all new files will inherit the directory's group). This allows for
-		// different users (being part of that group) to create, modify and delete the contained checksum and log files.
-		createChecksumDirCmd := fmt.Sprintf("mkdir -m2775 -p %s", checksumDir)
-
-		cmd, e := build.prepareInternalCommand(createChecksumDirCmd)
-		if e != nil {
-			return e
-		}
-		err := &bytes.Buffer{}
-
-		cmd.SetStderr(err)
-
-		if e := cmd.Run(); e != nil {
-			return fmt.Errorf(err.String() + ": " + e.Error())
-		}
+	if c.command == nil {
+		return fmt.Errorf("task %q: command %d is not part of the template", t.Name, c.Index)
 	}
-
-	// find commands that need not be executed
-	for i, cmd := range tsk.commands {
-		checksum, e := commandChecksum(cmd.command)
-		if e != nil {
-			return e
-		}
-
-		switch {
-		case len(checksumList) <= i || checksum != checksumList[i]:
-			return nil
-		default:
-			cmd.cached = true
-		}
+	if b.runID == "" {
+		b.runID = newRunID(time.Now())
 	}
-
+	m := b.message(pubsub.MessageCommand, t.Name)
+	m.TaskChecksum = c.Checksum
+	m.Message = c.LogMsg
+	m.ExecStatus = pubsub.StatusExecStart
+	m.Publish("started")
+	var err error
+	if r, ok := c.command.command.(cmd.Rebooter); ok {
+		err = b.reboot(ctx, t, c, r.RebootTimeout())
+	} else {
+		err = b.runCommand(ctx, t, c)
+	}
+	if err != nil {
+		m.ExecStatus = pubsub.StatusExecFailed
+		m.PublishError(err)
+		b.rollback(ctx, t, c)
+		return err
+	}
+	m.ExecStatus = pubsub.StatusExecFinished
+	m.Publish("finished")
+	if b.executed == nil {
+		b.executed = map[*TaskPlan][]*CommandPlan{}
+	}
+	b.executed[t] = append(b.executed[t], c)
 	return nil
 }
 
-func (build *Build) buildTask(tsk *task) (e error) {
-	checksumDir := fmt.Sprintf(ukCACHEDIR+"/%s", tsk.name)
-
-	tsk.started = time.Now()
-
-	for _, cmd := range tsk.commands {
-		checksum := cmd.Checksum()
-
-		m := message(pubsub.MessageTasksProvisionTask, build.hostname(), tsk.name)
-		m.TaskChecksum = checksum
-		m.Message = cmd.LogMsg()
-
-		var cmdErr error
-
-		switch {
-		case cmd.cached:
-			m.ExecStatus = pubsub.StatusCached
-		default:
-			m.ExecStatus = pubsub.StatusExecStart
-			m.Publish("started")
-
-			r := &commandRunner{
-				build:    build,
-				command:  cmd.command,
-				dir:      checksumDir,
-				taskName: tsk.name,
-			}
-			cmdErr = r.run()
-
-			m.Error = cmdErr
-			m.ExecStatus = pubsub.StatusExecFinished
-		}
-		m.Publish("finished")
-		err := build.addCmdToTaskLog(tsk, checksumDir, checksum, cmdErr)
-		switch {
-		case cmdErr != nil:
-			return cmdErr
-		case err != nil:
-			return err
+func (b *Build) runCommand(ctx context.Context, t *TaskPlan, c *CommandPlan) error {
+	log, err := b.exec(ctx, t, c)
+	rerr := b.record(t, c, err != nil, log)
+	switch {
+	case err != nil:
+		if rerr != nil {
+			logError(rerr)
 		}
+		return err
+	default:
+		return rerr
 	}
+}
 
-	return nil
+func (b *Build) record(t *TaskPlan, c *CommandPlan, failed bool, log []byte) error {
+	return b.stateStore().Record(b.Target, &CommandRecord{
+		Task:      t.Name,
+		Run:       b.runID,
+		Checksum:  c.Checksum,
+		Content:   c.Content,
+		Checksums: t.checksums(c.Index),
+		Failed:    failed,
+		Log:       log,
+	})
 }
 
-// addCmdToTaskLog will manage the log of run commands in a file. This file gets append the path to a file
-// for each command, that contains the executed script. The filename contains either ".done" or ".failed" as
-// suffix, depending on the err given (nil or not).
-func (build *Build) addCmdToTaskLog(tsk *task, checksumDir, checksum string, err error) (e error) {
-	prefix := checksumDir + "/" + checksum
-	sourceFile := prefix + ".sh"
-	targetFile := prefix + ".done"
+// Execute the command on the target and return its output.
+func (b *Build) exec(ctx context.Context, t *TaskPlan, c *CommandPlan) ([]byte, error) {
+	if err := checkRunAs(targetRunAs(b.Target), c.command.command); err != nil {
+		return nil, err
+	}
+	// The user name is validated, so it can be used without quoting. The
+	// content of the plan is masked, the actual shell code is run.
+	user := runAsUser(c.command.command)
+	env := b.env()
+	cm, err := render(cmdTpl, struct {
+		Command, User string
+		Env           bool
+	}{Command: c.command.command.Shell(), User: user, Env: env != nil})
 	if err != nil {
-		logError(err)
-		targetFile = prefix + ".failed"
+		return nil, err
 	}
-	rawCmd := fmt.Sprintf("{ [ -f %[1]s ] || mv %[2]s %[1]s; } && echo %[1]s >> %[3]s/%[4]s.run",
-		targetFile, sourceFile, checksumDir, tsk.started.Format("20060102_150405"))
-	c, e := build.prepareInternalCommand(rawCmd)
-	if e != nil {
-		return e
+	ec, err := b.Target.Command(cm)
+	if err != nil {
+		return nil, err
 	}
-
-	return c.Run()
-}
-
-type checksumTree map[string][]string
-
-func (build *Build) buildChecksumTree() (ct checksumTree, e error) {
-	ct = checksumTree{}
-
-	rawCmd := fmt.Sprintf(
-		`[ -d %[1]s ] && { ls %[1]s | while read dir; do ls -t %[1]s/$dir/*.run | head -n1 | xargs cat; done; }`,
-		ukCACHEDIR)
-	cmd, e := build.prepareInternalCommand(rawCmd)
-	if e != nil {
-		return nil, e
+	// Commands that can't be killed would keep running after their timeout.
+	timeout := b.commandTimeout(c.command.command)
+	if _, ok := ec.(target.Killer); timeout > 0 && !ok {
+		return nil, fmt.Errorf("task %q: command %q has a timeout, but commands on target %s can't be killed", t.Name, c.LogMsg, b.hostname())
 	}
-	out := &bytes.Buffer{}
-	err := &bytes.Buffer{}
-
-	cmd.SetStdout(out)
-	cmd.SetStderr(err)
-
-	if e := cmd.Run(); e != nil {
-		return nil, fmt.Errorf("%s: out=%s err=%s", e.Error(), out.String(), err.String())
+	var stdin io.Reader
+	if sc, ok := c.command.command.(cmd.StdinConsumer); ok {
+		stdin = sc.Input()
+		defer sc.Input().Close()
 	}
-
-	for _, line := range strings.Split(out.String(), "\n") {
-		line = strings.TrimSpace(line)
-
-		if line == "" || !strings.HasSuffix(line, ".done") {
-			continue
+	if env != nil {
+		readers := []io.Reader{bytes.NewReader(env)}
+		if stdin != nil {
+			readers = append(readers, stdin)
 		}
-
-		pkgname := filepath.Dir(strings.TrimPrefix(line, ukCACHEDIR+"/"))
-		checksum := strings.TrimSuffix(filepath.Base(line), ".done")
-		if len(checksum) != 64 {
-			return nil, fmt.Errorf("invalid checksum %q found for package %q", checksum, pkgname)
+		stdin = io.MultiReader(readers...)
+	}
+	if stdin != nil {
+		ec.SetStdin(stdin)
+	}
+	o, err := ec.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	e, err := ec.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	log := &commandLog{}
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	publish := func(stream, line string) {
+		m := b.message(pubsub.MessageCommandOutput, t.Name)
+		m.TaskChecksum = c.Checksum
+		m.Stream = stream
+		m.Line = line
+		m.Publish("line")
+	}
+	go consumeStream("stderr", e, wg, log, b.secrets, publish)
+	go consumeStream("stdout", o, wg, log, b.secrets, publish)
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err = ec.Start(); err != nil {
+		// Commands failing to start don't necessarily close their pipes.
+		for _, p := range []interface{}{o, e, ec} {
+			if cl, ok := p.(io.Closer); ok {
+				cl.Close()
+			}
+		}
+	} else {
+		done := make(chan error, 1)
+		go func() {
+			done <- ec.Wait()
+		}()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			if timeout > 0 {
+				err = &TimeoutError{Task: t.Name, Command: c.LogMsg, Timeout: timeout, Err: err}
+			}
+			if k, ok := ec.(target.Killer); ok {
+				if kerr := k.Kill(); kerr != nil {
+					logError(kerr)
+				}
+				select {
+				case <-done:
+				case <-time.After(killWait):
+					// The command survived, its output isn't waited for.
+					return log.Bytes(), err
+				}
+			}
+			wg.Wait()
+			return log.Bytes(), err
 		}
-		ct[pkgname] = append(ct[pkgname], checksum)
 	}
-
-	return ct, nil
-}
-
-func (build *Build) prepareCommand(rawCmd string) (target.ExecCommand, error) {
-	var sudo string
-	if build.User() != "root" {
-		sudo = "sudo "
+	wg.Wait()
+	if err != nil {
+		err = &BuildError{
+			Host:     b.hostname(),
+			Task:     t.Name,
+			Index:    c.Index,
+			Checksum: c.Checksum,
+			Command:  c.LogMsg,
+			ExitCode: exitCode(err),
+			Stderr:   log.stderrTail(),
+			Err:      err,
+		}
 	}
-	return build.Command(sudo + rawCmd)
+	return log.Bytes(), err
 }
 
-func (build *Build) prepareInternalCommand(rawCmd string) (target.ExecCommand, error) {
-	rawCmd = fmt.Sprintf("sh -x -e <<\"EOC\"\n%s\nEOC\n", rawCmd)
-	return build.prepareCommand(rawCmd)
-}
+// How long to wait for commands to terminate after killing them.
+var killWait = 10 * time.Second
 
-func (build *Build) hostname() string {
-	if s, ok := build.Target.(fmt.Stringer); ok {
-		return s.String()
+// The command's own timeout takes precedence over the build's default.
+func (b *Build) commandTimeout(c cmd.Command) time.Duration {
+	if t, ok := c.(cmd.Timeouter); ok && t.Timeout() > 0 {
+		return t.Timeout()
 	}
-	return "MISSING"
+	return b.CommandTimeout
 }
 
-func (b *Build) commandAction(name string, checksums []string, c *commandWrapper) func() error {
-	return func() error {
-		s := struct {
-			Command, Checksum, Name string
-			ChecksumFiles           string
-		}{
-			Command:       c.command.Shell(),
-			Checksum:      c.Checksum(),
-			Name:          name,
-			ChecksumFiles: strings.Join(checksums, "\n"),
-		}
-		cm, err := render(cmdTpl, s)
-		if err != nil {
-			return err
-		}
-		wg := &sync.WaitGroup{}
-		defer wg.Wait()
-		ec, err := b.Target.Command(cm)
-		if err != nil {
-			return err
-		}
-		o, err := ec.StdoutPipe()
-		if err != nil {
-			return err
-		}
-		e, err := ec.StderrPipe()
-		if err != nil {
-			return err
-		}
-		wg.Add(2)
-		l := b.maxLength
-		if l > maxKeyLogLength {
-			l = maxKeyLogLength
-		}
-		if len(name) > l {
-			name = midTrunc(name, maxKeyLogLength)
+// The output of a command as written to the state store: lines of timestamp,
+// stream and text separated by tabs.
+type commandLog struct {
+	mutex  sync.Mutex
+	buf    bytes.Buffer
+	stderr []string // the last lines of standard error
+}
+
+func (l *commandLog) add(stream, line string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if stream == "stderr" {
+		text := line
+		if fields := strings.SplitN(line, "\t", 3); len(fields) == 3 {
+			text = fields[2]
 		}
-		prefix := fmt.Sprintf("%s [%-*s]", b.Target.String(), l, name)
-		go consumeStream(prefix, gocli.Red, e, wg)
-		go consumeStream(prefix, func(in string) string { return in }, o, wg)
-		fmt.Println(prefix + " " + c.LogMsg())
-		if err := ec.Start(); err != nil {
-			return err
+		if len(l.stderr) == stderrTailLines {
+			l.stderr = l.stderr[1:]
 		}
-		return ec.Wait()
+		l.stderr = append(l.stderr, text)
+	}
+	if len(strings.Split(line, "\t")) < 3 {
+		line = time.Now().UTC().Format(time.RFC3339Nano) + "\t" + stream + "\t" + line
 	}
+	l.buf.WriteString(line + "\n")
+}
+
+func (l *commandLog) stderrTail() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string{}, l.stderr...)
 }
 
-func consumeStream(prefix string, form func(string) string, in io.Reader, wg *sync.WaitGroup) error {
+func (l *commandLog) Bytes() []byte {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buf.Bytes()
+}
+
+// Lines are published, so that loggers can write them to the console.
+func consumeStream(stream string, in io.Reader, wg *sync.WaitGroup, log *commandLog, s secrets, publish func(stream, line string)) error {
 	defer wg.Done()
 	scanner := bufio.NewScanner(in)
 
 	for scanner.Scan() {
-		fields := strings.Split(scanner.Text(), "\t")
-		if len(fields) > 2 {
-			fmt.Printf("%s %s\n", prefix, form(strings.Join(fields[2:], "\t")))
-		} else {
-			fmt.Printf("%s %s\n", prefix, form(scanner.Text()))
+		line := s.mask(scanner.Text())
+		log.add(stream, line)
+		if fields := strings.Split(line, "\t"); len(fields) > 2 {
+			line = strings.Join(fields[2:], "\t")
 		}
+		publish(stream, line)
 	}
 	return scanner.Err()
+}
 
+// The environment of the build's commands is sent on standard input (so that
+// the values don't show up in the process list of the target): a single line
+// with the base64 encoded export statements. Nil if no environment is set.
+func (b *Build) env() []byte {
+	lines := []string{}
+	for _, e := range b.Env {
+		lines = append(lines, "export "+shellQuote(e))
+	}
+	keys := []string{}
+	for k := range b.SecretEnv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lines = append(lines, "export "+shellQuote(k+"="+string(b.SecretEnv[k])))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, "\n")+"\n")) + "\n")
 }
 
 func render(t string, i interface{}) (string, error) {
@@ -438,6 +475,15 @@ func render(t string, i interface{}) (string, error) {
 	return buf.String(), err
 }
 
+// The command is written to a temporary file and executed from there, so that
+// standard input is available to the command. The build's environment is read
+// from standard input first and exported at the top of the file, which is
+// only readable by the user running the command. Every line of output is
+// prefixed with a timestamp and the stream it appeared on. The output is piped
+// (instead of using process substitution), so that no output is lost when the
+// command exits. Commands run as another user are executed in a login shell of
+// that user using sudo (like "su -l"), with the script handed over to that
+// user. The output is still recorded by the build.
 const cmdTpl = `set -e
 
 function iso8601 {
@@ -449,139 +495,33 @@ if [[ $(id -u) != 0 ]]; then
   sudo_prefix="sudo"
 fi
 
-build_date=$(TZ=utc date +"%Y%m%d_%H%M%S")
-dir=/var/lib/urknall/{{ .Name }}/build.$build_date
-
-$sudo_prefix mkdir -p $dir
+dir=$(mktemp -d /tmp/urknall.XXXXXXXX)
+trap "rm -rf $dir" EXIT
+script=$dir/script
 
-$sudo_prefix tee $dir/{{ .Checksum }}.sh > /dev/null <<"UKEOF"
+: > $script
+chmod 600 $script
+{{ if .Env }}IFS= read -r env
+echo "$env" | base64 -d >> $script
+{{ end }}cat >> $script <<"UKEOF"
 {{ .Command }}
 UKEOF
-
-done_path=$dir/{{ .Checksum }}.done
-run_path=$dir/$build_date.run
-log_path=$dir/{{ .Checksum }}.log
-uk_path=/var/lib/urknall/{{ .Name }}
-
-$sudo_prefix bash $dir/{{ .Checksum }}.sh 2> >(while read line; do echo "$(iso8601)	stderr	$line"; done | $sudo_prefix tee -a $log_path) > >(while read line; do echo "$(iso8601)	stdout	$line"; done | $sudo_prefix tee -a $log_path)
-
-$sudo_prefix mv $dir/{{ .Checksum }}.sh $dir/{{ .Checksum }}.done
-$sudo_prefix tee $run_path > /dev/null <<EOF
-{{ .ChecksumFiles }}
-EOF
-
-$sudo_prefix mkdir -p $uk_path
-$sudo_prefix cp $done_path $run_path $log_path $uk_path/
-`
-
-type taskState struct {
-	name    string
-	runSHAs []string
-	content map[string]string
-}
-
-const stateCmd = `
-bash <<"EOF"
-set -e
-
-if [[ $(whoami) == "root" ]]; then
-  mkdir -p /var/lib/urknall
+{{ if .User }}
+if [[ $(id -un) == {{ .User }} ]]; then
+  sudo_prefix=""
 else
-  sudo mkdir -p /var/lib/urknall
-fi
-files=$(find /var/lib/urknall -maxdepth 1 -mindepth 1 -type d)
-
-if [[ -z $files ]]; then
-  exit
+  chmod 711 $dir
+  $sudo_prefix chown {{ .User }} $script
+  sudo_prefix="sudo -i -u {{ .User }}"
 fi
-
-tar cvz $(
-	for dir in $files; do
-		last_run=$(ls -t $dir/*.run | head -n1)
-		echo $last_run
-		cat $last_run
-	done
-)
-EOF
-`
-
-func readState(target Target) (content map[string]*taskState, err error) {
-	b, err := capture(target, stateCmd)
-	if err != nil {
-		return nil, err
-	}
-	if len(b) == 0 {
-		return map[string]*taskState{}, nil
-	}
-
-	gz, err := gzip.NewReader(bytes.NewReader(b))
-	if err != nil {
-		return nil, err
-	}
-	defer gz.Close()
-	t := tar.NewReader(gz)
-
-	return readItemsFromTar(t)
-}
-
-func inspect(in interface{}) {
-	b, err := json.MarshalIndent(in, "", "  ")
-	if err == nil {
-		os.Stdout.Write(b)
-	}
-}
-
-func readItemsFromTar(t *tar.Reader) (m map[string]*taskState, err error) {
-	m = map[string]*taskState{}
-	for {
-		switch h, err := t.Next(); err {
-		case io.EOF:
-			return m, nil
-		case nil:
-			name := filepath.Base(filepath.Dir(h.Name))
-			b, err := ioutil.ReadAll(t)
-			if err != nil {
-				return nil, err
-			}
-			if _, ok := m[name]; !ok {
-				m[name] = &taskState{content: map[string]string{}}
-			}
-			switch n := h.Name; {
-			case strings.HasSuffix(n, ".run"):
-				for _, f := range strings.Split(strings.TrimSpace(string(b)), "\n") {
-					m[name].runSHAs = append(m[name].runSHAs, doneFileToChecksum(f))
-				}
-			case strings.HasSuffix(n, ".done"):
-				m[name].content[doneFileToChecksum(n)] = strings.TrimSuffix(strings.TrimPrefix(string(b), "#!/bin/sh\nset -e\nset -x\n\n\n"), "\n")
-			case strings.HasSuffix(n, ".log") || strings.HasSuffix(n, ".failed"):
-				// ignore for now
-			default:
-				return nil, fmt.Errorf("%s dir=%t has unsupported suffix", n, h.FileInfo().IsDir())
-			}
-		default:
-			return nil, err
-		}
-	}
-}
-
-func doneFileToChecksum(in string) string {
-	return strings.TrimSuffix(filepath.Base(in), ".done")
+{{ end }}
+function stamp {
+  while IFS= read -r line || [[ -n $line ]]; do echo "$(iso8601)	$1	$line"; done
 }
 
-func loadExecutedTasks(target Target, name string) (m map[string][]string, err error) {
-	c, err := target.Command("ls -t /var/lib/urknall/" + name + "/*.run | head -n 1 | xargs cat")
-	if err != nil {
-		return nil, err
-	}
-	stdOut := &bytes.Buffer{}
-	stdErr := &bytes.Buffer{}
-	c.SetStderr(stdErr)
-	c.SetStdout(stdOut)
-	if err := c.Run(); err != nil {
-		return nil, err
-	}
-	return nil, nil
-}
+set -o pipefail
+{ $sudo_prefix bash $script 2>&1 1>&3 | stamp stderr >&2; } 3>&1 | stamp stdout
+`
 
 func capture(target Target, cmd string) ([]byte, error) {
 	c, err := target.Command(cmd)
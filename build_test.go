@@ -0,0 +1,199 @@
+package urknall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dynport/urknall/target"
+)
+
+type timeoutCommand struct {
+	*testCommand
+	timeout time.Duration
+}
+
+func (c *timeoutCommand) Timeout() time.Duration {
+	return c.timeout
+}
+
+func TestCommandTimeout(t *testing.T) {
+	b := &Build{}
+	if v := b.commandTimeout(&testCommand{cmd: "echo 1"}); v != 0 {
+		t.Errorf("expected no timeout, got %s", v)
+	}
+
+	b.CommandTimeout = time.Minute
+	if v, ex := b.commandTimeout(&testCommand{cmd: "echo 1"}), time.Minute; v != ex {
+		t.Errorf("expected timeout to be %s, was %s", ex, v)
+	}
+
+	c := &timeoutCommand{testCommand: &testCommand{cmd: "sleep 10"}, timeout: time.Second}
+	if v, ex := b.commandTimeout(c), time.Second; v != ex {
+		t.Errorf("expected timeout to be %s, was %s", ex, v)
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	e := &TimeoutError{Task: "base", Command: "sleep 10", Timeout: time.Second, Err: context.DeadlineExceeded}
+	if v, ex := e.Error(), `task "base": command "sleep 10" timed out after 1s`; v != ex {
+		t.Errorf("expected error to be %q, was %q", ex, v)
+	}
+
+	e = &TimeoutError{Task: "base", Command: "sleep 10", Err: context.Canceled}
+	if v, ex := e.Error(), `task "base": command "sleep 10" aborted: context canceled`; v != ex {
+		t.Errorf("expected error to be %q, was %q", ex, v)
+	}
+}
+
+func TestRunContextTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall-timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The background process must be killed as well.
+	cmd := fmt.Sprintf("(sleep 1 && touch %[1]s/bg) & sleep 1; touch %[1]s/fg", dir)
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base", &testCommand{cmd: cmd})
+	})
+	b := &Build{Target: target.NewLocalTarget(), Template: tpl, State: NewMemoryStateStore(), CommandTimeout: 200 * time.Millisecond}
+	err = b.RunContext(context.Background())
+	var te *TimeoutError
+	if !errors.As(err, &te) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	for _, name := range []string{"fg", "bg"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("expected file %q not to be created by the killed command", name)
+		}
+	}
+
+	// Timeouts are rejected for targets whose commands can't be killed.
+	b = &Build{Target: unkillableTarget{target.NewLocalTarget()}, Template: tpl, State: NewMemoryStateStore(), CommandTimeout: time.Second}
+	if err := b.Run(); err == nil || !strings.Contains(err.Error(), "can't be killed") {
+		t.Errorf("expected build to be rejected, got %v", err)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base", &testCommand{cmd: "sleep 5"})
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	b := &Build{Target: target.NewLocalTarget(), Template: tpl, State: NewMemoryStateStore()}
+	if err := b.RunContext(ctx); err != context.Canceled {
+		t.Errorf("expected error %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestRunKillFailure(t *testing.T) {
+	defer func(d time.Duration) { killWait = d }(killWait)
+	killWait = 100 * time.Millisecond
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base", &testCommand{cmd: "sleep 3"})
+	})
+	b := &Build{Target: failingTarget{target.NewLocalTarget(), "kill"}, Template: tpl, State: NewMemoryStateStore(), CommandTimeout: 100 * time.Millisecond}
+	started := time.Now()
+	var te *TimeoutError
+	if err := b.Run(); !errors.As(err, &te) {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if d := time.Since(started); d > 2*time.Second {
+		t.Errorf("expected build not to wait for the command that couldn't be killed, took %s", d)
+	}
+}
+
+func TestRunStartFailure(t *testing.T) {
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base", &testCommand{cmd: "echo 1"})
+	})
+	b := &Build{Target: failingTarget{target.NewLocalTarget(), "start"}, Template: tpl, State: NewMemoryStateStore()}
+	var be *BuildError
+	if err := b.Run(); !errors.As(err, &be) {
+		t.Fatalf("expected build error, got %v", err)
+	}
+	if v, ex := be.Task, "base"; v != ex {
+		t.Errorf("expected task %q, got %q", ex, v)
+	}
+}
+
+// Target whose commands fail to start or to be killed.
+type failingTarget struct {
+	Target
+	fail string
+}
+
+func (t failingTarget) Command(cmd string) (target.ExecCommand, error) {
+	c, err := t.Target.Command(cmd)
+	return &failingCommand{ExecCommand: c, fail: t.fail}, err
+}
+
+type failingCommand struct {
+	target.ExecCommand
+	fail string
+}
+
+func (c *failingCommand) Start() error {
+	if c.fail == "start" {
+		return errors.New("failed to start")
+	}
+	return c.ExecCommand.Start()
+}
+
+func (c *failingCommand) Kill() error {
+	return errors.New("failed to kill")
+}
+
+type unkillableTarget struct {
+	Target
+}
+
+func (t unkillableTarget) Command(cmd string) (target.ExecCommand, error) {
+	c, err := t.Target.Command(cmd)
+	return struct{ target.ExecCommand }{c}, err
+}
+
+func TestBuildError(t *testing.T) {
+	err := exec.Command("bash", "-c", "exit 3").Run()
+	if v := exitCode(err); v != 3 {
+		t.Errorf("expected exit code 3, got %d", v)
+	}
+	if v := exitCode(errors.New("broken pipe")); v != -1 {
+		t.Errorf("expected unknown exit code to be -1, got %d", v)
+	}
+
+	e := &BuildError{Host: "host", Task: "base", Index: 2, Command: "false", ExitCode: 3, Err: err}
+	if v, ex := e.Error(), `host: task "base": command 2 "false" failed with exit code 3`; v != ex {
+		t.Errorf("expected error to be %q, was %q", ex, v)
+	}
+	var ee *exec.ExitError
+	if !errors.As(fmt.Errorf("build: %w", e), &ee) {
+		t.Errorf("expected build error to wrap the exit error")
+	}
+	e = &BuildError{Host: "host", Task: "base", Command: "false", ExitCode: -1, Err: errors.New("broken pipe")}
+	if v, ex := e.Error(), `host: task "base": command 0 "false" failed: broken pipe`; v != ex {
+		t.Errorf("expected error to be %q, was %q", ex, v)
+	}
+}
+
+func TestCommandLogStderrTail(t *testing.T) {
+	l := &commandLog{}
+	for i := 0; i < 15; i++ {
+		l.add("stderr", fmt.Sprintf("line %d", i))
+		l.add("stdout", "out")
+	}
+	tail := l.stderrTail()
+	if len(tail) != stderrTailLines || tail[0] != "line 5" || tail[9] != "line 14" {
+		t.Errorf("expected the last %d lines of stderr, got %v", stderrTailLines, tail)
+	}
+}
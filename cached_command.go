@@ -4,7 +4,6 @@ import "github.com/dynport/urknall/cmd"
 
 type commandWrapper struct {
 	command cmd.Command
-	cached  bool
 
 	checksum string
 	logMsg   string
@@ -22,10 +21,12 @@ func (cw *commandWrapper) Checksum() string {
 }
 
 func (cw *commandWrapper) LogMsg() string {
-	if logger, ok := cw.command.(cmd.Logger); ok {
-		cw.logMsg = logger.Logging()
-	} else {
-		cw.logMsg = cw.command.Shell()
+	if cw.logMsg == "" {
+		if logger, ok := cw.command.(cmd.Logger); ok {
+			cw.logMsg = logger.Logging()
+		} else {
+			cw.logMsg = cw.command.Shell()
+		}
 	}
 
 	return cw.logMsg
@@ -3,7 +3,10 @@
 // This package contains a set of interfaces, commands must or can implement.
 package cmd
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 // The Command interface is used to have specialized commands that are used for
 // execution and logging (the latter is useful to hide the gory details of more
@@ -39,3 +42,34 @@ type Renderer interface {
 type Validator interface {
 	Validate() error
 }
+
+// Commands that might not terminate on their own (waiting for a network
+// resource for example) can limit the time they are allowed to run. A command
+// exceeding its timeout is killed and the build fails.
+type Timeouter interface {
+	Timeout() time.Duration
+}
+
+// Commands rebooting the target implement the Rebooter interface. The build
+// waits for the target to return (at most the returned duration), records the
+// command as executed and then continues with the next command.
+type Rebooter interface {
+	RebootTimeout() time.Duration
+}
+
+// Commands that must not run as root implement the UserSwitcher interface. The
+// command is run in a login shell of the returned user using sudo (like with
+// "su -l", the profile is loaded and the user's home is the working
+// directory). Environment variables of the build are passed on. The user is
+// part of the command's checksum. Targets running all commands as a fixed user
+// can't run commands as another one.
+type UserSwitcher interface {
+	RunAs() string
+}
+
+// Commands whose changes to the target can be reverted implement the Undoer
+// interface. If a later command of the same task fails, the returned commands
+// of all commands executed in that build are run in reverse order.
+type Undoer interface {
+	Undo() Command
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import "time"
+
+const defaultRebootTimeout = 5 * time.Minute
+
+// A command rebooting the target (after kernel upgrades for example). The
+// reboot is delayed a little, so that the command can finish before the
+// connection is lost.
+type Reboot struct {
+	Wait time.Duration // Time to wait for the target to return (5 minutes if not set).
+}
+
+func (r *Reboot) Shell() string {
+	return "setsid nohup sh -c 'sleep 2 && reboot' > /dev/null 2>&1 < /dev/null &"
+}
+
+func (r *Reboot) Logging() string {
+	return "[REBOOT]"
+}
+
+func (r *Reboot) RebootTimeout() time.Duration {
+	if r.Wait > 0 {
+		return r.Wait
+	}
+	return defaultRebootTimeout
+}
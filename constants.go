@@ -1,7 +1,5 @@
 package urknall
 
 const (
-	ukGROUP         = "urknall"          // Group used for cache file ownership on host.
-	ukCACHEDIR      = "/var/lib/urknall" // Directory for urknall cache.
-	maxKeyLogLength = 48                 // pick something fixed for now
+	ukCACHEDIR = "/var/lib/urknall" // Directory for urknall cache.
 )
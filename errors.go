@@ -0,0 +1,75 @@
+package urknall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A TimeoutError is returned by a build if a command with a timeout was
+// aborted, either because it exceeded its timeout or the build's context was
+// cancelled. Commands without a timeout return the context's error.
+type TimeoutError struct {
+	Task    string        // Name of the task the command belongs to.
+	Command string        // Log message of the aborted command.
+	Timeout time.Duration // Timeout of the command (zero if none was set).
+	Err     error         // Error of the context that caused the abort.
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Timeout > 0 && e.Err == context.DeadlineExceeded {
+		return fmt.Sprintf("task %q: command %q timed out after %s", e.Task, e.Command, e.Timeout)
+	}
+	return fmt.Sprintf("task %q: command %q aborted: %s", e.Task, e.Command, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Number of lines of standard error kept with a BuildError.
+const stderrTailLines = 10
+
+// A BuildError is returned by a build if a command failed on the target. The
+// error the command failed with is available using errors.Unwrap.
+type BuildError struct {
+	Host     string   // Target the command was run on.
+	Task     string   // Name of the task the command belongs to.
+	Index    int      // Index of the command in the task.
+	Checksum string   // Checksum of the command.
+	Command  string   // Log message of the command.
+	ExitCode int      // Exit code of the command (-1 if not known).
+	Stderr   []string // The last lines written to standard error.
+	Err      error    // The error the command failed with.
+}
+
+func (e *BuildError) Error() string {
+	if e.ExitCode < 0 {
+		return fmt.Sprintf("%s: task %q: command %d %q failed: %s", e.Host, e.Task, e.Index, e.Command, e.Err)
+	}
+	return fmt.Sprintf("%s: task %q: command %d %q failed with exit code %d", e.Host, e.Task, e.Index, e.Command, e.ExitCode)
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// The lines of standard error are shown by the default logger.
+func (e *BuildError) StderrTail() []string {
+	return e.Stderr
+}
+
+// Targets report exit codes differently (the exec and ssh packages use
+// ExitCode and ExitStatus respectively).
+func exitCode(err error) int {
+	var status interface{ ExitStatus() int }
+	if errors.As(err, &status) {
+		return status.ExitStatus()
+	}
+	var code interface{ ExitCode() int }
+	if errors.As(err, &code) {
+		return code.ExitCode()
+	}
+	return -1
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"strings"
 
@@ -32,10 +33,26 @@ func Shell(cmd string) *ShellCommand {
 }
 
 func (sc *ShellCommand) Shell() string {
+	return sc.Command
+}
+
+// Commands are run as the given user by the build (in a login shell, like
+// "su -l").
+func (sc *ShellCommand) RunAs() string {
 	if sc.isExecutedAsUser() {
-		return fmt.Sprintf("su -l %s <<EOF_ZWO_ASUSER\n%s\nEOF_ZWO_ASUSER\n", sc.user, sc.Command)
+		return sc.user
 	}
-	return sc.Command
+	return ""
+}
+
+// Commands run as another user were wrapped in "su -l" before. The checksum of
+// the wrapped command is kept, so that provisioned hosts don't run them again.
+func (sc *ShellCommand) Checksum() string {
+	s := sc.Command
+	if sc.isExecutedAsUser() {
+		s = fmt.Sprintf("su -l %s <<EOF_ZWO_ASUSER\n%s\nEOF_ZWO_ASUSER\n", sc.user, sc.Command)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
 }
 
 func (sc *ShellCommand) Logging() string {
@@ -36,5 +36,14 @@ func run() error {
 	if e != nil {
 		return e
 	}
-	return urknall.Run(target, &Template{})
+	tpl := &Template{}
+	if len(os.Args) > 1 && os.Args[1] == "prune" {
+		// Remove the state of tasks the template doesn't produce anymore.
+		removed, e := urknall.Prune(target, tpl)
+		for _, name := range removed {
+			logger.Printf("removed task %q", name)
+		}
+		return e
+	}
+	return urknall.Run(target, tpl)
 }
@@ -0,0 +1,115 @@
+package urknall
+
+import (
+	"context"
+	"time"
+
+	"github.com/dynport/dgtk/confirm"
+	"github.com/dynport/urknall/pubsub"
+)
+
+// An executor carries out the plan of a build. Executors implement the
+// different modes of a build (like actually running the commands or only
+// showing what would be done), while all share the same plan computed from the
+// state found on the target.
+type Executor interface {
+	Execute(ctx context.Context, b *Build, p *Plan) error
+}
+
+// The default executor running all pending commands of the plan on the
+// build's target. If the build has a Confirm function set, the commands are
+// handed over for confirmation instead.
+type RunExecutor struct{}
+
+// Messages are published when a task is started, finished or failed, and for
+// tasks and commands that are cached.
+func (ex *RunExecutor) Execute(ctx context.Context, b *Build, p *Plan) error {
+	actions := confirm.Actions{}
+	for _, t := range p.Tasks {
+		if t.Orphaned {
+			continue
+		}
+		pending := []*CommandPlan{}
+		for _, c := range t.Commands {
+			if c.Pending() {
+				pending = append(pending, c)
+			}
+		}
+		for _, c := range t.Commands {
+			if c.Status == PlanCached {
+				cm := b.message(pubsub.MessageCommand, t.Name)
+				cm.TaskChecksum = c.Checksum
+				cm.Message = c.LogMsg
+				cm.ExecStatus = pubsub.StatusCached
+				cm.Publish("cached")
+			}
+		}
+		m := b.message(pubsub.MessageTask, t.Name)
+		if len(pending) == 0 {
+			m.ExecStatus = pubsub.StatusCached
+			m.Publish("cached")
+			continue
+		}
+		for i, c := range pending {
+			var pl []byte
+			if _, content, ok, err := extractWriteFile(c.Content); err == nil && ok {
+				pl = []byte(content)
+			}
+			t, c, first, last := t, c, i == 0, i == len(pending)-1
+			actions.Create(t.Name+" "+c.LogMsg, pl, func() error {
+				if first {
+					m.StartedAt = time.Now()
+					m.ExecStatus = pubsub.StatusExecStart
+					m.Publish("started")
+				}
+				if err := b.RunCommand(ctx, t, c); err != nil {
+					m.ExecStatus = pubsub.StatusExecFailed
+					m.PublishError(err)
+					return err
+				}
+				if last {
+					m.ExecStatus = pubsub.StatusExecFinished
+					m.Publish("finished")
+				}
+				return nil
+			})
+		}
+	}
+
+	if b.Confirm != nil {
+		return b.Confirm(actions...)
+	}
+	for _, a := range actions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := a.Call(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The dry run executor publishes a message for every command of the plan,
+// whether it would be executed or is cached. Nothing is run on the target.
+type DryRunExecutor struct{}
+
+func (ex *DryRunExecutor) Execute(ctx context.Context, b *Build, p *Plan) error {
+	for _, t := range p.Tasks {
+		for _, c := range t.Commands {
+			m := b.message(pubsub.MessageTasksProvisionTask, t.Name)
+			m.TaskChecksum = c.Checksum
+			m.Message = c.LogMsg
+
+			switch {
+			case c.Status == PlanCached:
+				m.ExecStatus = pubsub.StatusCached
+				m.Publish("finished")
+			case c.Pending():
+				m.ExecStatus = pubsub.StatusExecStart
+				m.Publish("executed")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dynport/dgtk/confirm"
+	"github.com/dynport/urknall/cmd"
+	"github.com/dynport/urknall/pubsub"
+	"github.com/dynport/urknall/target"
+)
+
+func appendTemplate(file string, lines ...string) Template {
+	return TemplateFunc(func(p Package) {
+		cmds := []cmd.Command{}
+		for _, l := range lines {
+			cmds = append(cmds, &testCommand{cmd: "echo " + l + " >> " + file})
+		}
+		p.AddCommands("base", cmds...)
+	})
+}
+
+func readLines(t *testing.T, file string) []string {
+	b, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(b))
+}
+
+func TestRunExecutor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall-executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "out")
+
+	state := NewMemoryStateStore()
+	b := &Build{Target: target.NewLocalTarget(), Template: appendTemplate(file, "a", "b"), State: state}
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := readLines(t, file), []string{"a", "b"}; !reflect.DeepEqual(v, ex) {
+		t.Errorf("expected lines %v, got %v", ex, v)
+	}
+
+	// Cached commands are skipped.
+	events := pubsub.NewEvents()
+	keys := []string{}
+	events.Subscribe(pubsub.SinkFunc(func(m *pubsub.Message) {
+		if m.ExecStatus == pubsub.StatusCached {
+			keys = append(keys, m.Key)
+		}
+	}))
+	b = &Build{Target: target.NewLocalTarget(), Template: appendTemplate(file, "a", "b", "c"), State: state, Events: events}
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := readLines(t, file), []string{"a", "b", "c"}; !reflect.DeepEqual(v, ex) {
+		t.Errorf("expected lines %v, got %v", ex, v)
+	}
+	if v, ex := len(keys), 2; v != ex {
+		t.Errorf("expected %d cached messages, got %d: %v", ex, v, keys)
+	}
+
+	// Pending commands are handed over for confirmation.
+	var actions []*confirm.Action
+	b = &Build{Target: target.NewLocalTarget(), Template: appendTemplate(file, "a", "b", "d", "e"), State: state}
+	b.Confirm = func(a ...*confirm.Action) error {
+		actions = a
+		return nil
+	}
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := len(actions), 2; v != ex {
+		t.Errorf("expected %d actions, got %d", ex, v)
+	}
+	if v, ex := readLines(t, file), []string{"a", "b", "c"}; !reflect.DeepEqual(v, ex) {
+		t.Errorf("expected nothing to be executed before confirmation, got %v", v)
+	}
+	for _, a := range actions {
+		if err := a.Call(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, ex := readLines(t, file), []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(v, ex) {
+		t.Errorf("expected lines %v, got %v", ex, v)
+	}
+}
+
+func TestDryRunExecutor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall-executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "out")
+
+	state := NewMemoryStateStore()
+	b := &Build{Target: target.NewLocalTarget(), Template: appendTemplate(file, "a"), State: state}
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := pubsub.NewEvents()
+	statuses := []string{}
+	events.Subscribe(pubsub.SinkFunc(func(m *pubsub.Message) {
+		if strings.HasPrefix(m.Key, pubsub.MessageTasksProvisionTask+".") {
+			statuses = append(statuses, m.ExecStatus)
+		}
+	}))
+	b = &Build{Target: target.NewLocalTarget(), Template: appendTemplate(file, "a", "b"), State: state, Events: events}
+	if err := b.DryRun(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := statuses, []string{pubsub.StatusCached, pubsub.StatusExecStart}; !reflect.DeepEqual(v, ex) {
+		t.Errorf("expected statuses %v, got %v", ex, v)
+	}
+	if v, ex := readLines(t, file), []string{"a"}; !reflect.DeepEqual(v, ex) {
+		t.Errorf("expected nothing to be executed, got %v", v)
+	}
+	ts, err := state.ReadState(b.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := len(ts["base"].Checksums); v != 1 {
+		t.Errorf("expected nothing to be recorded, got %d commands", v)
+	}
+}
+
+type preparingStore struct {
+	StateStore
+	prepared int
+}
+
+func (s *preparingStore) Prepare(Target, string) error {
+	s.prepared++
+	return nil
+}
+
+func TestBuildPrepare(t *testing.T) {
+	state := &preparingStore{StateStore: NewMemoryStateStore()}
+	b := &Build{Target: target.NewLocalTarget(), Template: appendTemplate("/dev/null", "a"), State: state}
+	if _, err := b.Plan(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DryRun(); err != nil {
+		t.Fatal(err)
+	}
+	if state.prepared != 0 {
+		t.Errorf("expected plan and dry run not to prepare the target, got %d calls", state.prepared)
+	}
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if state.prepared != 1 {
+		t.Errorf("expected run to prepare the target once, got %d calls", state.prepared)
+	}
+}
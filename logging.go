@@ -1,6 +1,7 @@
 package urknall
 
 import (
+	"log"
 	"time"
 
 	"github.com/dynport/urknall/pubsub"
@@ -9,3 +10,20 @@ import (
 func message(key string, hostname string, taskName string) (msg *pubsub.Message) {
 	return &pubsub.Message{Key: key, StartedAt: time.Now(), Hostname: hostname, TaskName: taskName}
 }
+
+// Messages of the build are published to the build's events.
+func (b *Build) message(key string, taskName string) (msg *pubsub.Message) {
+	events := b.Events
+	if events == nil {
+		events = pubsub.DefaultEvents()
+	}
+	msg = events.NewMessage(key)
+	msg.StartedAt = time.Now()
+	msg.Hostname = b.hostname()
+	msg.TaskName = taskName
+	return msg
+}
+
+func logError(e error) {
+	log.Printf("ERROR: %s", e.Error())
+}
@@ -0,0 +1,155 @@
+package urknall
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dynport/urknall/pubsub"
+	"github.com/dynport/urknall/target"
+)
+
+func TestBuildEvents(t *testing.T) {
+	def := 0
+	defer pubsub.DefaultEvents().Subscribe(pubsub.SinkFunc(func(m *pubsub.Message) {
+		if m.Key == pubsub.MessageTasksProvisionTask+".executed" {
+			def++
+		}
+	}))()
+
+	builds := map[string][]string{}
+	mutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, name := range []string{"a", "b"} {
+		name := name
+		events := pubsub.NewEvents()
+		events.Subscribe(pubsub.SinkFunc(func(m *pubsub.Message) {
+			if !strings.HasPrefix(m.Key, pubsub.MessageTasksProvisionTask) {
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			builds[name] = append(builds[name], m.TaskName)
+		}))
+		tpl := TemplateFunc(func(p Package) {
+			p.AddCommands(name, Shell("echo 1"), Shell("echo 2"))
+		})
+		b := &Build{Target: target.NewLocalTarget(), Template: tpl, State: NewMemoryStateStore(), Events: events}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := b.DryRun(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, name := range []string{"a", "b"} {
+		if v := builds[name]; len(v) != 2 || v[0] != name || v[1] != name {
+			t.Errorf("expected build %q to only get its own messages, got %v", name, v)
+		}
+	}
+	if def != 0 {
+		t.Errorf("expected no messages on the default events, got %d", def)
+	}
+}
+
+func TestBuildLifecycleEvents(t *testing.T) {
+	events := pubsub.NewEvents()
+	msgs := []*pubsub.Message{}
+	events.Subscribe(pubsub.SinkFunc(func(m *pubsub.Message) {
+		msgs = append(msgs, m)
+	}))
+	keys := func() string {
+		k := []string{}
+		for _, m := range msgs {
+			k = append(k, strings.TrimPrefix(m.Key, "urknall.")+" "+m.TaskName+" "+m.Stream+" "+m.Line)
+		}
+		msgs = nil
+		return strings.Join(k, "\n")
+	}
+
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base", Shell("echo out"), Shell("echo err >&2"))
+	})
+	b := &Build{Target: target.NewLocalTarget(), Template: tpl, State: NewMemoryStateStore(), Events: events}
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+	ex := strings.Join([]string{
+		"build.started   ",
+		"tasks.provision.list.planned   ",
+		"task.started base  ",
+		"command.started base  ",
+		"command.output.line base stdout out",
+		"command.finished base  ",
+		"command.started base  ",
+		"command.output.line base stderr err",
+		"command.finished base  ",
+		"task.finished base  ",
+		"build.finished   ",
+	}, "\n")
+	if v := keys(); v != ex {
+		t.Errorf("expected messages\n%s\ngot\n%s", ex, v)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+	ex = strings.Join([]string{
+		"build.started   ",
+		"tasks.provision.list.planned   ",
+		"command.cached base  ",
+		"command.cached base  ",
+		"task.cached base  ",
+		"build.finished   ",
+	}, "\n")
+	if v := keys(); v != ex {
+		t.Errorf("expected messages\n%s\ngot\n%s", ex, v)
+	}
+}
+
+func TestBuildOutput(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	events := pubsub.NewEvents()
+	buf := &bytes.Buffer{}
+	logger := pubsub.OpenLogger(buf, pubsub.WithJSONLines(), pubsub.WithEvents(events))
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base", Shell("echo out"))
+	})
+	b := &Build{Target: target.NewLocalTarget(), Template: tpl, State: NewMemoryStateStore(), Events: events}
+	err = b.Run()
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) > 0 {
+		t.Errorf("expected nothing to be written to stdout, got %q", out)
+	}
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !strings.HasPrefix(l, "{") {
+			t.Errorf("expected only JSON lines to be logged, got %q", l)
+		}
+	}
+	if !strings.Contains(buf.String(), `"line":"out"`) {
+		t.Errorf("expected output to be logged, got %q", buf.String())
+	}
+}
@@ -0,0 +1,110 @@
+package urknall
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A single line of output of a command executed in an earlier run.
+type LogLine struct {
+	Time     time.Time `json:"time"`
+	Run      string    `json:"run"`
+	Checksum string    `json:"checksum"`
+	Stream   string    `json:"stream"` // Either "stdout" or "stderr".
+	Line     string    `json:"line"`
+}
+
+func (l *LogLine) String() string {
+	return fmt.Sprintf("%s\t%s\t%.12s\t%s\t%s", l.Time.Format(time.RFC3339Nano), l.Run, l.Checksum, l.Stream, l.Line)
+}
+
+// Read the logs of the last runs of the given task from the state store (the
+// same store a build would use if nil). All runs are read if runs is not
+// positive. The lines are ordered by their timestamps and can be limited to the
+// given streams.
+func ReadLogs(t Target, s StateStore, task string, runs int, streams ...string) ([]*LogLine, error) {
+	s = stateStoreFor(t, s)
+	all, err := s.ListRuns(t, task)
+	if err != nil {
+		return nil, err
+	}
+	if runs > 0 && len(all) > runs {
+		all = all[len(all)-runs:]
+	}
+	lines := logLines{}
+	for _, run := range all {
+		logs, err := s.RunLogs(t, task, run.ID)
+		if err != nil {
+			return nil, err
+		}
+		// The order of the commands is used for lines with equal timestamps.
+		for _, cs := range append(append([]string{}, run.Done...), run.Failed...) {
+			if b, ok := logs[cs]; ok {
+				lines = append(lines, parseLog(run.ID, cs, b)...)
+				delete(logs, cs)
+			}
+		}
+		rest := []string{}
+		for cs := range logs {
+			rest = append(rest, cs)
+		}
+		sort.Strings(rest)
+		for _, cs := range rest {
+			lines = append(lines, parseLog(run.ID, cs, logs[cs])...)
+		}
+	}
+	sort.Stable(lines)
+	if len(streams) == 0 {
+		return lines, nil
+	}
+	filtered := []*LogLine{}
+	for _, l := range lines {
+		for _, s := range streams {
+			if l.Stream == s {
+				filtered = append(filtered, l)
+				break
+			}
+		}
+	}
+	return filtered, nil
+}
+
+// Log lines are made of the timestamp, the stream and the text separated by
+// tabs. Lines without a timestamp get the one of the preceding line.
+func parseLog(run, checksum string, b []byte) []*LogLine {
+	lines := []*LogLine{}
+	var last time.Time
+	for _, raw := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if raw == "" {
+			continue
+		}
+		l := &LogLine{Run: run, Checksum: checksum, Time: last, Line: raw}
+		if fields := strings.SplitN(raw, "\t", 3); len(fields) == 3 {
+			if t, ok := parseLogTime(fields[0]); ok {
+				l.Time, l.Stream, l.Line = t, fields[1], fields[2]
+				last = t
+			}
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+// The timestamps written on the host use a comma as decimal mark.
+func parseLogTime(in string) (time.Time, bool) {
+	in = strings.Replace(in, ",", ".", 1)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+		if t, err := time.Parse(layout, in); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+type logLines []*LogLine
+
+func (l logLines) Len() int           { return len(l) }
+func (l logLines) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l logLines) Less(i, j int) bool { return l[i].Time.Before(l[j].Time) }
@@ -0,0 +1,77 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseLog(t *testing.T) {
+	b := []byte("2015-01-01T12:00:00,000000002\tstdout\tfirst\tline\nno timestamp\n2015-01-01T12:00:01.5Z\tstderr\tthird\n")
+	lines := parseLog("run", "cs", b)
+	if len(lines) != 3 {
+		t.Fatalf("expected %d lines, got %d", 3, len(lines))
+	}
+	tests := []struct {
+		stream, line string
+		nanos        int
+	}{
+		{"stdout", "first\tline", 2},
+		{"", "no timestamp", 2},
+		{"stderr", "third", 500000000},
+	}
+	for i, tc := range tests {
+		l := lines[i]
+		if l.Stream != tc.stream || l.Line != tc.line || l.Time.Nanosecond() != tc.nanos {
+			t.Errorf("expected line %d to be %s/%q/%d, got %s/%q/%d", i, tc.stream, tc.line, tc.nanos, l.Stream, l.Line, l.Time.Nanosecond())
+		}
+	}
+}
+
+func TestReadLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewLocalStateStore(dir)
+	tg := &unreachableTarget{name: "host"}
+	for _, r := range []*CommandRecord{
+		{Task: "base", Run: "20150101_120000", Checksum: "a", Checksums: []string{"a"},
+			Log: []byte("2015-01-01T12:00:00,1\tstdout\tone\n")},
+		{Task: "base", Run: "20150102_120000", Checksum: "a", Checksums: []string{"a"},
+			Log: []byte("2015-01-02T12:00:00,1\tstdout\ttwo\n2015-01-02T12:00:00,4\tstderr\tfour\n")},
+		{Task: "base", Run: "20150102_120000", Checksum: "b", Checksums: []string{"a", "b"}, Failed: true,
+			Log: []byte("2015-01-02T12:00:00,3\tstdout\tthree\n")},
+	} {
+		if err := s.Record(tg, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		runs    int
+		streams []string
+		out     string
+	}{
+		{0, nil, "one,two,three,four"},
+		{1, nil, "two,three,four"},
+		{1, []string{"stderr"}, "four"},
+		{0, []string{"stdout"}, "one,two,three"},
+	}
+	for _, tc := range tests {
+		lines, err := ReadLogs(tg, s, "base", tc.runs, tc.streams...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := []string{}
+		for _, l := range lines {
+			out = append(out, l.Line)
+		}
+		if v := strings.Join(out, ","); v != tc.out {
+			t.Errorf("expected lines of %d runs with streams %v to be %q, got %q", tc.runs, tc.streams, tc.out, v)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package urknall
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A shortcut creating and running a multi build provisioning all the given
+// targets with the given template.
+func RunMany(targets []Target, tpl Template, opts ...func(*MultiBuild)) (*MultiBuildResult, error) {
+	return RunManyContext(context.Background(), targets, tpl, opts...)
+}
+
+// Like RunMany, but all builds are aborted if the given context is cancelled.
+func RunManyContext(ctx context.Context, targets []Target, tpl Template, opts ...func(*MultiBuild)) (*MultiBuildResult, error) {
+	mb := &MultiBuild{Targets: targets, Template: tpl}
+	for _, o := range opts {
+		o(mb)
+	}
+	return mb.RunContext(ctx)
+}
+
+// A multi build provisions a set of targets with the same template. Every
+// target gets a build of its own, i.e. caching works per host the same way it
+// does for single builds.
+type MultiBuild struct {
+	Targets  []Target // Where to run the builds.
+	Template Template // What to actually build.
+
+	Concurrency     int            // Maximum number of parallel builds (unlimited if not set).
+	Strategy        BatchStrategy  // How targets are split into batches (AllAtOnce if not set).
+	ContinueOnError bool           // Keep on provisioning remaining targets if a build failed.
+	BuildOptions    []func(*Build) // Options applied to the build of each target.
+}
+
+// A batch strategy splits the targets into batches. Batches are provisioned
+// one after another, i.e. the next batch is only started if all builds of the
+// current one have finished. The batches must consist of the given targets.
+type BatchStrategy func(targets []Target) [][]Target
+
+// Provision all targets in a single batch.
+func AllAtOnce(targets []Target) [][]Target {
+	if len(targets) == 0 {
+		return nil
+	}
+	return [][]Target{targets}
+}
+
+// Provision targets in batches of the given size.
+func Rolling(size int) BatchStrategy {
+	return func(targets []Target) (batches [][]Target) {
+		if size < 1 {
+			return AllAtOnce(targets)
+		}
+		for len(targets) > size {
+			batches = append(batches, targets[:size])
+			targets = targets[size:]
+		}
+		if len(targets) > 0 {
+			batches = append(batches, targets)
+		}
+		return batches
+	}
+}
+
+// Provision the first n targets as canaries in a batch of their own. The
+// remaining targets are split using the given strategy (all at once if nil).
+func Canary(n int, rest BatchStrategy) BatchStrategy {
+	if rest == nil {
+		rest = AllAtOnce
+	}
+	return func(targets []Target) [][]Target {
+		if n < 1 || n >= len(targets) {
+			return AllAtOnce(targets)
+		}
+		return append([][]Target{targets[:n]}, rest(targets[n:])...)
+	}
+}
+
+// The result of the build of a single target.
+type HostResult struct {
+	Host     string        // Name of the target.
+	Err      error         // Error of the build (nil on success).
+	Skipped  bool          // Set if the build was not started due to a previous failure.
+	Started  time.Time     // When the build was started.
+	Duration time.Duration // How long the build took.
+}
+
+func (r *HostResult) status() string {
+	switch {
+	case r.Skipped:
+		return "SKIPPED"
+	case r.Err != nil:
+		return "FAILED"
+	default:
+		return "OK"
+	}
+}
+
+// The aggregated result of a multi build. Results are in the order of the
+// build's targets.
+type MultiBuildResult struct {
+	Hosts []*HostResult
+}
+
+// Results of all targets with a failed build.
+func (r *MultiBuildResult) Failed() (failed []*HostResult) {
+	for _, h := range r.Hosts {
+		if h.Err != nil {
+			failed = append(failed, h)
+		}
+	}
+	return failed
+}
+
+// Results of all targets not provisioned due to failures.
+func (r *MultiBuildResult) Skipped() (skipped []*HostResult) {
+	for _, h := range r.Hosts {
+		if h.Skipped {
+			skipped = append(skipped, h)
+		}
+	}
+	return skipped
+}
+
+// A report with a line per target.
+func (r *MultiBuildResult) String() string {
+	l := 0
+	for _, h := range r.Hosts {
+		if len(h.Host) > l {
+			l = len(h.Host)
+		}
+	}
+	lines := []string{}
+	for _, h := range r.Hosts {
+		line := fmt.Sprintf("%-*s %-8s", l, h.Host, h.status())
+		if !h.Skipped {
+			line += fmt.Sprintf(" %8.3fs", h.Duration.Seconds())
+		}
+		if h.Err != nil {
+			line += " " + h.Err.Error()
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Run the builds of all targets.
+func (mb *MultiBuild) Run() (*MultiBuildResult, error) {
+	return mb.RunContext(context.Background())
+}
+
+// Like Run, but all builds are aborted if the given context is cancelled.
+func (mb *MultiBuild) RunContext(ctx context.Context) (*MultiBuildResult, error) {
+	// Render once upfront, so that template errors are found before any host
+	// is touched. The rendered package is shared by all builds, as rendering
+	// modifies the template (e.g. setting default values). As rendering isn't
+	// part of a single build, its messages go to the default events.
+	pkg, err := renderTemplate(mb.Template, nil)
+	if err != nil {
+		return nil, err
+	}
+	pkg.precompute()
+
+	// The strategy is given the targets along with their position, so that
+	// results are found for any target (even if not comparable or given
+	// twice).
+	res := &MultiBuildResult{}
+	targets := []Target{}
+	for i, t := range mb.Targets {
+		res.Hosts = append(res.Hosts, &HostResult{Host: t.String(), Skipped: true})
+		targets = append(targets, &batchTarget{Target: t, index: i})
+	}
+
+	strategy := mb.Strategy
+	if strategy == nil {
+		strategy = AllAtOnce
+	}
+	for _, batch := range strategy(targets) {
+		if failed := mb.runBatch(ctx, batch, pkg, res.Hosts); failed && !mb.ContinueOnError {
+			break
+		}
+	}
+
+	if failed := res.Failed(); len(failed) > 0 {
+		return res, fmt.Errorf("build failed for %d of %d targets", len(failed), len(mb.Targets))
+	}
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+type batchTarget struct {
+	Target
+	index int // position in the multi build's targets
+}
+
+func (mb *MultiBuild) runBatch(ctx context.Context, batch []Target, pkg *packageImpl, results []*HostResult) (failed bool) {
+	concurrency := mb.Concurrency
+	if concurrency < 1 || concurrency > len(batch) {
+		concurrency = len(batch)
+	}
+	sem := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+	mutex := &sync.Mutex{}
+
+	for _, t := range batch {
+		bt, ok := t.(*batchTarget)
+		if !ok {
+			panic(fmt.Sprintf("batch strategy returned unknown target %s", t))
+		}
+		sem <- struct{}{}
+		mutex.Lock()
+		stop := ctx.Err() != nil || (failed && !mb.ContinueOnError)
+		mutex.Unlock()
+		if stop {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(t Target, r *HostResult) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			b := &Build{Target: t, Template: mb.Template, pkg: pkg}
+			for _, o := range mb.BuildOptions {
+				o(b)
+			}
+			r.Skipped = false
+			r.Started = time.Now()
+			r.Err = b.RunContext(ctx)
+			r.Duration = time.Since(r.Started)
+			if r.Err != nil {
+				mutex.Lock()
+				failed = true
+				mutex.Unlock()
+			}
+		}(bt.Target, results[bt.index])
+	}
+	wg.Wait()
+	return failed
+}
@@ -0,0 +1,177 @@
+package urknall
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dynport/urknall/target"
+)
+
+type unreachableTarget struct {
+	name string
+}
+
+func (t *unreachableTarget) Command(cmd string) (target.ExecCommand, error) {
+	return nil, fmt.Errorf("%s is unreachable", t.name)
+}
+
+func (t *unreachableTarget) User() string   { return "root" }
+func (t *unreachableTarget) String() string { return t.name }
+func (t *unreachableTarget) Reset() error   { return nil }
+
+func testTargets(names ...string) (targets []Target) {
+	for _, n := range names {
+		targets = append(targets, &unreachableTarget{name: n})
+	}
+	return targets
+}
+
+func batchNames(batches [][]Target) string {
+	parts := []string{}
+	for _, b := range batches {
+		names := []string{}
+		for _, t := range b {
+			names = append(names, t.String())
+		}
+		parts = append(parts, strings.Join(names, ","))
+	}
+	return strings.Join(parts, "|")
+}
+
+func TestBatchStrategies(t *testing.T) {
+	targets := testTargets("a", "b", "c", "d", "e")
+	tests := []struct {
+		Name     string
+		Strategy BatchStrategy
+		Expected string
+	}{
+		{"all", AllAtOnce, "a,b,c,d,e"},
+		{"rolling", Rolling(2), "a,b|c,d|e"},
+		{"canary", Canary(1, nil), "a|b,c,d,e"},
+		{"canary rolling", Canary(1, Rolling(3)), "a|b,c,d|e"},
+		{"canary all", Canary(5, Rolling(3)), "a,b,c,d,e"},
+	}
+	for _, tst := range tests {
+		if v := batchNames(tst.Strategy(targets)); v != tst.Expected {
+			t.Errorf("%s: expected batches to be %q, were %q", tst.Name, tst.Expected, v)
+		}
+	}
+}
+
+func TestRunManyStopOnFailure(t *testing.T) {
+	targets := testTargets("a", "b", "c")
+	res, err := RunMany(targets, &genericPkg{}, func(mb *MultiBuild) {
+		mb.Concurrency = 1
+	})
+	if err == nil {
+		t.Fatal("expected an error, got none")
+	}
+	if len(res.Hosts) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(res.Hosts))
+	}
+	if v := len(res.Failed()); v != 1 {
+		t.Errorf("expected 1 failed build, got %d", v)
+	}
+	if v := len(res.Skipped()); v != 2 {
+		t.Errorf("expected 2 skipped builds, got %d", v)
+	}
+	if res.Hosts[0].Err == nil || res.Hosts[1].Err != nil || !res.Hosts[1].Skipped {
+		t.Errorf("expected first build to fail and second to be skipped, got %s", res)
+	}
+}
+
+func TestRunManyContinueOnError(t *testing.T) {
+	targets := testTargets("a", "b", "c")
+	res, err := RunMany(targets, &genericPkg{}, func(mb *MultiBuild) {
+		mb.Strategy = Rolling(1)
+		mb.ContinueOnError = true
+	})
+	if err == nil || err.Error() != "build failed for 3 of 3 targets" {
+		t.Errorf("expected error for all targets, got %v", err)
+	}
+	if v := len(res.Skipped()); v != 0 {
+		t.Errorf("expected no skipped builds, got %d", v)
+	}
+}
+
+type defaultsTemplate struct {
+	Flag bool   `urknall:"default=true"`
+	Name string `urknall:"default=host"`
+}
+
+func (tpl *defaultsTemplate) Render(p Package) {
+	p.AddCommands("base", &testCommand{cmd: "echo {{ .Name }} {{ .Flag }}"})
+}
+
+type namedTarget struct {
+	Target
+	name string
+}
+
+func (t *namedTarget) String() string { return t.name }
+
+func TestRunMany(t *testing.T) {
+	targets := []Target{}
+	for _, n := range []string{"a", "b", "c"} {
+		targets = append(targets, &namedTarget{Target: target.NewLocalTarget(), name: n})
+	}
+	stores := map[string]StateStore{}
+	for _, tg := range targets {
+		stores[tg.String()] = NewMemoryStateStore()
+	}
+	res, err := RunMany(targets, &defaultsTemplate{}, func(mb *MultiBuild) {
+		mb.BuildOptions = append(mb.BuildOptions, func(b *Build) {
+			b.State = stores[b.Target.String()]
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := len(res.Failed()) + len(res.Skipped()); v != 0 {
+		t.Errorf("expected all builds to succeed, got %s", res)
+	}
+	for _, tg := range targets {
+		logs, err := ReadLogs(tg, stores[tg.String()], "base", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(logs) != 1 || logs[0].Line != "host true" {
+			t.Errorf("%s: expected output %q, got %v", tg, "host true", logs)
+		}
+	}
+}
+
+// A target that can't be used as map key.
+type tagsTarget struct {
+	Target
+	name string
+	tags []string
+}
+
+func (t tagsTarget) String() string { return t.name }
+
+func TestRunManyTargets(t *testing.T) {
+	dup := &namedTarget{Target: target.NewLocalTarget(), name: "dup"}
+	targets := []Target{
+		tagsTarget{Target: target.NewLocalTarget(), name: "tags", tags: []string{"web"}},
+		dup,
+		dup,
+	}
+	res, err := RunMany(targets, &defaultsTemplate{}, func(mb *MultiBuild) {
+		mb.BuildOptions = append(mb.BuildOptions, func(b *Build) {
+			b.State = NewMemoryStateStore()
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := len(res.Hosts); v != 3 {
+		t.Fatalf("expected %d results, got %d", 3, v)
+	}
+	for i, r := range res.Hosts {
+		if r.Skipped || r.Err != nil {
+			t.Errorf("expected build %d (%s) to succeed, got %s", i, r.Host, res)
+		}
+	}
+}
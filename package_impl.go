@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/dynport/urknall/cmd"
+	"github.com/dynport/urknall/pubsub"
 	"github.com/dynport/urknall/utils"
 )
 
@@ -13,6 +14,9 @@ type packageImpl struct {
 	taskNames      map[string]struct{}
 	reference      interface{} // used for rendering
 	cacheKeyPrefix string
+	secrets        []Secret // values of the templates' secret fields
+
+	message func(key, taskName string) *pubsub.Message // messages published while rendering (default events if nil)
 }
 
 func (pkg *packageImpl) AddCommands(name string, cmds ...cmd.Command) {
@@ -43,11 +47,12 @@ func (pkg *packageImpl) AddTemplate(name string, tpl Template) {
 		name = utils.MustRenderTemplate(name, pkg.reference)
 	}
 	pkg.validateTaskName(name)
-	child := &packageImpl{cacheKeyPrefix: name, reference: tpl}
+	child := &packageImpl{cacheKeyPrefix: name, reference: tpl, secrets: templateSecrets(tpl), message: pkg.message}
 	tpl.Render(child)
 	for _, task := range child.tasks {
 		pkg.addTask(task)
 	}
+	pkg.secrets = append(pkg.secrets, child.secrets...)
 }
 
 func (pkg *packageImpl) AddTask(name string, tsk Task) {
@@ -56,6 +61,11 @@ func (pkg *packageImpl) AddTask(name string, tsk Task) {
 	}
 	name = utils.MustRenderTemplate(name, pkg.reference)
 	t := &task{name: name}
+	if tt, ok := tsk.(*task); ok {
+		if e := tt.compile(pkg.message); e != nil {
+			panic(e)
+		}
+	}
 	cmds, e := tsk.Commands()
 	if e != nil {
 		panic(e)
@@ -63,9 +73,29 @@ func (pkg *packageImpl) AddTask(name string, tsk Task) {
 	for _, c := range cmds {
 		t.Add(c)
 	}
+	if h, ok := tsk.(FailureHandler); ok {
+		cmds, e := h.FailureCommands()
+		if e != nil {
+			panic(e)
+		}
+		for _, c := range cmds {
+			t.onFailure = append(t.onFailure, &commandWrapper{command: c})
+		}
+	}
 	pkg.addTask(t)
 }
 
+// Compute the checksums and log messages of all commands, so that the package
+// can be shared by concurrent builds.
+func (pkg *packageImpl) precompute() {
+	for _, t := range pkg.tasks {
+		for _, c := range append(append([]*commandWrapper{}, t.commands...), t.onFailure...) {
+			c.Checksum()
+			c.LogMsg()
+		}
+	}
+}
+
 func (pkg *packageImpl) addTask(task *task) {
 	pkg.validateTaskName(task.name)
 	pkg.taskNames[task.name] = struct{}{}
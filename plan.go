@@ -0,0 +1,239 @@
+package urknall
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dynport/urknall/utils"
+)
+
+// The status of a command in a build plan.
+type PlanStatus string
+
+const (
+	PlanCached   PlanStatus = "cached"   // Executed before, won't be executed again.
+	PlanChanged  PlanStatus = "changed"  // Differs from the command executed before at this position.
+	PlanNew      PlanStatus = "new"      // No command was executed before at this position.
+	PlanRerun    PlanStatus = "rerun"    // Unchanged, but executed again as a preceding command changed.
+	PlanOrphaned PlanStatus = "orphaned" // Executed before, but not part of the template anymore.
+)
+
+// A plan describes what a build would do on a target, i.e. which commands
+// are cached and which must be executed, compared to the state found on the
+// target.
+type Plan struct {
+	Host  string      `json:"host"`
+	Tasks []*TaskPlan `json:"tasks"`
+
+	secrets secrets
+}
+
+// The plan of a single task.
+type TaskPlan struct {
+	Name     string         `json:"name"`
+	Orphaned bool           `json:"orphaned,omitempty"` // The task is not part of the template anymore.
+	Commands []*CommandPlan `json:"commands"`
+
+	onFailure []*commandWrapper
+}
+
+// The plan of a single command. Content is the command's shell code, the old
+// values are those of the command executed at the same position before.
+// Secrets are masked in the log message and the content.
+type CommandPlan struct {
+	Index       int        `json:"index"`
+	Status      PlanStatus `json:"status"`
+	Checksum    string     `json:"checksum,omitempty"`
+	LogMsg      string     `json:"log_msg,omitempty"`
+	Content     string     `json:"content,omitempty"`
+	OldChecksum string     `json:"old_checksum,omitempty"`
+	OldContent  string     `json:"old_content,omitempty"`
+
+	command *commandWrapper
+}
+
+// Checksums of the task's commands up to and including the one with the given
+// index.
+func (t *TaskPlan) checksums(idx int) (checksums []string) {
+	for _, c := range t.Commands[:idx+1] {
+		checksums = append(checksums, c.Checksum)
+	}
+	return checksums
+}
+
+// Whether the command will be executed by the build.
+func (c *CommandPlan) Pending() bool {
+	switch c.Status {
+	case PlanChanged, PlanNew, PlanRerun:
+		return true
+	}
+	return false
+}
+
+// Number of commands that will be executed by the build.
+func (p *Plan) Pending() (cnt int) {
+	for _, t := range p.Tasks {
+		for _, c := range t.Commands {
+			if c.Pending() {
+				cnt++
+			}
+		}
+	}
+	return cnt
+}
+
+// Count the commands of the plan with the given status.
+func (p *Plan) Count(status PlanStatus) (cnt int) {
+	for _, t := range p.Tasks {
+		for _, c := range t.Commands {
+			if c.Status == status {
+				cnt++
+			}
+		}
+	}
+	return cnt
+}
+
+// Render the plan as indented JSON.
+func (p *Plan) JSON() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
+
+// Render the plan as a human readable unified diff. Cached commands are left
+// out. For commands writing files the diff is created from the file's content
+// instead of the encoded shell command.
+func (p *Plan) Diff() string {
+	out := []string{}
+	for _, t := range p.Tasks {
+		lines := []string{}
+		for _, c := range t.Commands {
+			if c.Status == PlanCached {
+				continue
+			}
+			name := fmt.Sprintf("%s/%d", t.Name, c.Index)
+			from, to := diffContent(c.OldContent), diffContent(c.Content)
+			lines = append(lines, strings.TrimSpace(fmt.Sprintf("# %s %s %s", name, strings.ToUpper(string(c.Status)), c.LogMsg)))
+			if d := utils.UnifiedDiff(diffName("a/"+name, c.OldChecksum), diffName("b/"+name, c.Checksum), from, to); d != "" {
+				lines = append(lines, strings.TrimSuffix(d, "\n"))
+			}
+		}
+		if len(lines) > 0 {
+			header := "## task " + t.Name
+			if t.Orphaned {
+				header += " (orphaned)"
+			}
+			out = append(out, header)
+			out = append(out, lines...)
+		}
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+func diffName(name, checksum string) string {
+	if len(checksum) > 12 {
+		checksum = checksum[:12]
+	}
+	if checksum == "" {
+		return name
+	}
+	return name + " " + checksum
+}
+
+func diffContent(s string) string {
+	if path, content, ok, err := extractWriteFile(s); err == nil && ok {
+		return "# file " + path + "\n" + content
+	}
+	return s
+}
+
+// Compute the plan of the build comparing the template with the state found
+// on the target.
+func (b *Build) Plan() (*Plan, error) {
+	pkg, err := b.render()
+	if err != nil {
+		return nil, err
+	}
+	state, err := b.stateStore().ReadState(b.Target)
+	if err != nil {
+		return nil, err
+	}
+	secrets := append([]Secret{}, b.Secrets...)
+	for _, s := range b.SecretEnv {
+		secrets = append(secrets, s)
+	}
+	if err := checkSecrets(append(append([]Secret{}, pkg.secrets...), secrets...)); err != nil {
+		return nil, err
+	}
+	return newPlan(b.hostname(), pkg, state, secrets...), nil
+}
+
+// The package rendered upfront is used if set (see MultiBuild).
+func (b *Build) render() (*packageImpl, error) {
+	if b.pkg != nil {
+		return b.pkg, nil
+	}
+	return renderTemplate(b.Template, b.message)
+}
+
+func newPlan(host string, pkg *packageImpl, state map[string]*TaskState, extra ...Secret) *Plan {
+	p := &Plan{Host: host, secrets: newSecrets(append(append([]Secret{}, pkg.secrets...), extra...)...)}
+	seen := map[string]struct{}{}
+	for _, t := range pkg.tasks {
+		seen[t.name] = struct{}{}
+		tp := &TaskPlan{Name: t.name, onFailure: t.onFailure}
+		ex := &TaskState{}
+		if s, ok := state[t.name]; ok {
+			ex = s
+		}
+
+		broken := false
+		for i, c := range t.commands {
+			cp := &CommandPlan{Index: i, Checksum: c.Checksum(), LogMsg: p.secrets.mask(c.LogMsg()), Content: p.secrets.maskShell(c.command.Shell()), command: c}
+			switch {
+			case len(ex.Checksums) <= i:
+				cp.Status = PlanNew
+			case ex.Checksums[i] != cp.Checksum:
+				cp.Status = PlanChanged
+			case broken:
+				cp.Status = PlanRerun
+			default:
+				cp.Status = PlanCached
+			}
+			if len(ex.Checksums) > i {
+				cp.OldChecksum = ex.Checksums[i]
+				cp.OldContent = ex.Content[cp.OldChecksum]
+			}
+			broken = broken || cp.Status != PlanCached
+			tp.Commands = append(tp.Commands, cp)
+		}
+		for i := len(t.commands); i < len(ex.Checksums); i++ {
+			tp.Commands = append(tp.Commands, orphanedCommand(ex, i))
+		}
+		p.Tasks = append(p.Tasks, tp)
+	}
+
+	orphaned := []string{}
+	for name := range state {
+		if _, ok := seen[name]; !ok {
+			orphaned = append(orphaned, name)
+		}
+	}
+	sort.Strings(orphaned)
+	for _, name := range orphaned {
+		tp := &TaskPlan{Name: name, Orphaned: true}
+		for i := range state[name].Checksums {
+			tp.Commands = append(tp.Commands, orphanedCommand(state[name], i))
+		}
+		p.Tasks = append(p.Tasks, tp)
+	}
+	return p
+}
+
+func orphanedCommand(s *TaskState, i int) *CommandPlan {
+	return &CommandPlan{Index: i, Status: PlanOrphaned, OldChecksum: s.Checksums[i], OldContent: s.Content[s.Checksums[i]]}
+}
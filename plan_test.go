@@ -0,0 +1,101 @@
+package urknall
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func testPlan(t *testing.T) *Plan {
+	pkg := &packageImpl{}
+	pkg.AddCommands("base", Shell("echo 1"), Shell("echo 2"), Shell("echo 3"))
+	pkg.AddCommands("fresh", Shell("echo fresh"))
+	pkg.AddCommands("short", Shell("echo a"))
+
+	checksum := func(s string) string {
+		cs, err := commandChecksum(Shell(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cs
+	}
+	state := map[string]*TaskState{
+		"base": {
+			Checksums: []string{checksum("echo 1"), checksum("echo two"), checksum("echo 3")},
+			Content:   map[string]string{checksum("echo 1"): "echo 1", checksum("echo two"): "echo two", checksum("echo 3"): "echo 3"},
+		},
+		"short": {
+			Checksums: []string{checksum("echo a"), checksum("echo b")},
+			Content:   map[string]string{checksum("echo a"): "echo a", checksum("echo b"): "echo b"},
+		},
+		"removed": {
+			Checksums: []string{checksum("echo removed")},
+			Content:   map[string]string{checksum("echo removed"): "echo removed"},
+		},
+	}
+	return newPlan("host", pkg, state)
+}
+
+func TestNewPlan(t *testing.T) {
+	p := testPlan(t)
+
+	statuses := []string{}
+	for _, tp := range p.Tasks {
+		s := []string{}
+		for _, c := range tp.Commands {
+			s = append(s, string(c.Status))
+		}
+		statuses = append(statuses, tp.Name+":"+strings.Join(s, ","))
+	}
+	ex := "base:cached,changed,rerun fresh:new short:cached,orphaned removed:orphaned"
+	if v := strings.Join(statuses, " "); v != ex {
+		t.Errorf("expected statuses to be %q, were %q", ex, v)
+	}
+	if !p.Tasks[3].Orphaned {
+		t.Errorf("expected task %q to be orphaned", p.Tasks[3].Name)
+	}
+	if v, ex := p.Pending(), 3; v != ex {
+		t.Errorf("expected %d pending commands, got %d", ex, v)
+	}
+	if v, ex := p.Count(PlanOrphaned), 2; v != ex {
+		t.Errorf("expected %d orphaned commands, got %d", ex, v)
+	}
+	if v, ex := p.Tasks[0].Commands[1].OldContent, "echo two"; v != ex {
+		t.Errorf("expected old content to be %q, was %q", ex, v)
+	}
+}
+
+func TestPlanDiff(t *testing.T) {
+	d := testPlan(t).Diff()
+	for _, ex := range []string{
+		"## task base\n# base/1 CHANGED echo 2\n--- a/base/1 ",
+		"@@ -1,1 +1,1 @@\n-echo two\n+echo 2\n",
+		"# base/2 RERUN echo 3\n## task fresh",
+		"--- a/fresh/0\n+++ b/fresh/0 ",
+		"## task removed (orphaned)\n# removed/0 ORPHANED\n--- a/removed/0 ",
+	} {
+		if !strings.Contains(d, ex) {
+			t.Errorf("expected diff to contain %q, got\n%s", ex, d)
+		}
+	}
+	if strings.Contains(d, "base/0") {
+		t.Errorf("expected diff not to contain cached commands, got\n%s", d)
+	}
+}
+
+func TestPlanJSON(t *testing.T) {
+	b, err := testPlan(t).JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Plan{}
+	if err := json.Unmarshal(b, p); err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := len(p.Tasks), 4; v != ex {
+		t.Fatalf("expected %d tasks, got %d", ex, v)
+	}
+	if v, ex := p.Tasks[0].Commands[1].Status, PlanChanged; v != ex {
+		t.Errorf("expected status to be %q, was %q", ex, v)
+	}
+}
@@ -0,0 +1,83 @@
+package pubsub
+
+import "sync"
+
+// A sink receives published messages. The PubSub type of the
+// http://github.com/dynport/dgtk/pubsub package is a sink.
+type Sink interface {
+	Publish(i interface{}) error
+}
+
+// Use a function as sink receiving all messages.
+type SinkFunc func(m *Message)
+
+func (f SinkFunc) Publish(i interface{}) error {
+	if m, ok := i.(*Message); ok {
+		f(m)
+	}
+	return nil
+}
+
+// Events dispatch the messages of builds to their sinks. Sinks can be added and
+// removed while builds are running.
+type Events struct {
+	mutex  sync.RWMutex
+	sinks  []*subscription
+	nextID int
+}
+
+type subscription struct {
+	id   int
+	sink Sink
+}
+
+// Create events without any sinks.
+func NewEvents() *Events {
+	return &Events{}
+}
+
+var defaultEvents = NewEvents()
+
+// The events used by builds without events of their own. Loggers opened using
+// OpenLogger are subscribed to them by default.
+func DefaultEvents() *Events {
+	return defaultEvents
+}
+
+// Add the sink. The returned function removes it again.
+func (e *Events) Subscribe(s Sink) (unsubscribe func()) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	id := e.nextID
+	e.nextID++
+	e.sinks = append(e.sinks, &subscription{id: id, sink: s})
+	return func() {
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		for i, sub := range e.sinks {
+			if sub.id == id {
+				e.sinks = append(e.sinks[:i:i], e.sinks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Hand the message to all sinks (in the order they were added). The first
+// error of a sink is returned.
+func (e *Events) Publish(m *Message) (err error) {
+	e.mutex.RLock()
+	sinks := e.sinks
+	e.mutex.RUnlock()
+	for _, sub := range sinks {
+		if e := sub.sink.Publish(m); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Create a message published to the events (instead of the default events).
+func (e *Events) NewMessage(key string) *Message {
+	return &Message{Key: key, events: e}
+}
@@ -0,0 +1,81 @@
+package pubsub
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordingSink struct {
+	mutex sync.Mutex
+	keys  []string
+}
+
+func (s *recordingSink) Publish(i interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = append(s.keys, i.(*Message).Key)
+	return nil
+}
+
+func (s *recordingSink) Keys() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return strings.Join(s.keys, ",")
+}
+
+func TestEvents(t *testing.T) {
+	e := NewEvents()
+	a, b := &recordingSink{}, &recordingSink{}
+	order := []string{}
+	unsubA := e.Subscribe(a)
+	e.Subscribe(SinkFunc(func(m *Message) { order = append(order, "func") }))
+	e.Subscribe(b)
+
+	e.NewMessage("one").Publish("finished")
+	unsubA()
+	unsubA()
+	e.NewMessage("two").Publish("finished")
+
+	if v := a.Keys(); v != "one.finished" {
+		t.Errorf("expected unsubscribed sink to get %q, got %q", "one.finished", v)
+	}
+	if v := b.Keys(); v != "one.finished,two.finished" {
+		t.Errorf("expected sink to get %q, got %q", "one.finished,two.finished", v)
+	}
+	if len(order) != 2 {
+		t.Errorf("expected function sink to be called twice, got %d", len(order))
+	}
+
+	// Messages of other events are not received.
+	def := &recordingSink{}
+	defer DefaultEvents().Subscribe(def)()
+	NewEvents().NewMessage("other").Publish("finished")
+	(&Message{Key: "default"}).Publish("finished")
+	if v := def.Keys(); v != "default.finished" {
+		t.Errorf("expected default events to only get %q, got %q", "default.finished", v)
+	}
+}
+
+func TestEventsConcurrency(t *testing.T) {
+	e := NewEvents()
+	s := &recordingSink{}
+	defer e.Subscribe(s)()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			e.NewMessage(fmt.Sprintf("msg%d", i)).Publish("finished")
+		}(i)
+		go func() {
+			defer wg.Done()
+			e.Subscribe(&recordingSink{})()
+		}()
+	}
+	wg.Wait()
+	if v := len(strings.Split(s.Keys(), ",")); v != 10 {
+		t.Errorf("expected 10 messages, got %d", v)
+	}
+}
@@ -0,0 +1,86 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Version of the JSON schema written by loggers using the WithJSONLines
+// option. The version is increased with incompatible changes only; fields might
+// be added without a change of the version.
+const JSONLogVersion = 1
+
+// Write every message as a single line of JSON (see JSONMessage), instead of
+// the colourised output of the default formatter.
+func WithJSONLines() LoggerOption {
+	return func(l *logger) {
+		l.Formatter = JSONFormatter
+	}
+}
+
+// A message as written by loggers using the WithJSONLines option. Durations are
+// given in seconds.
+type JSONMessage struct {
+	Version                 int         `json:"version"`
+	Key                     string      `json:"key"`
+	Hostname                string      `json:"host,omitempty"`
+	TaskName                string      `json:"task,omitempty"`
+	TaskChecksum            string      `json:"checksum,omitempty"`
+	ExecStatus              string      `json:"exec_status,omitempty"`
+	Message                 string      `json:"message,omitempty"`
+	Stream                  string      `json:"stream,omitempty"`
+	Line                    string      `json:"line,omitempty"`
+	StartedAt               time.Time   `json:"started_at"`
+	PublishedAt             time.Time   `json:"published_at"`
+	Duration                float64     `json:"duration"`
+	TotalRuntime            float64     `json:"total_runtime,omitempty"`
+	InvalidatedCacheEntries []string    `json:"invalidated_cache_entries,omitempty"`
+	Error                   string      `json:"error,omitempty"`
+	StderrTail              []string    `json:"stderr_tail,omitempty"`
+	Stack                   string      `json:"stack,omitempty"`
+	Report                  interface{} `json:"report,omitempty"`
+	EncodingError           string      `json:"encoding_error,omitempty"` // Set if the report couldn't be encoded.
+}
+
+// Create the JSON representation of the given message.
+func NewJSONMessage(m *Message) *JSONMessage {
+	j := &JSONMessage{
+		Version:                 JSONLogVersion,
+		Key:                     m.Key,
+		Hostname:                m.Hostname,
+		TaskName:                m.TaskName,
+		TaskChecksum:            m.TaskChecksum,
+		ExecStatus:              m.ExecStatus,
+		Message:                 m.Message,
+		Stream:                  m.Stream,
+		Line:                    m.Line,
+		StartedAt:               m.StartedAt,
+		PublishedAt:             m.PublishedAt,
+		Duration:                m.Duration.Seconds(),
+		TotalRuntime:            m.TotalRuntime.Seconds(),
+		InvalidatedCacheEntries: m.InvalidatedCacheEntries,
+		Stack:                   m.Stack,
+		Report:                  m.Report,
+	}
+	if m.Error != nil {
+		j.Error = m.Error.Error()
+		if e, ok := m.Error.(interface{ StderrTail() []string }); ok {
+			j.StderrTail = e.StderrTail()
+		}
+	}
+	return j
+}
+
+// Formatter writing the message as a single line of JSON. If the message's
+// report can't be encoded, the line is written without it.
+func JSONFormatter(m *Message) string {
+	j := NewJSONMessage(m)
+	b, err := json.Marshal(j)
+	if err != nil {
+		// All other fields can always be encoded.
+		j.Report = nil
+		j.EncodingError = err.Error()
+		b, _ = json.Marshal(j)
+	}
+	return string(b)
+}
@@ -0,0 +1,68 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type tailError struct {
+	error
+}
+
+func (e *tailError) StderrTail() []string {
+	return []string{"first", "second"}
+}
+
+func TestJSONLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := OpenLogger(buf, WithJSONLines())
+	m := &Message{Key: MessageTasksProvisionTask, Hostname: "host", TaskName: "base", TaskChecksum: "abc", StartedAt: time.Now().Add(-time.Second)}
+	m.ExecStatus = StatusExecFinished
+	m.Publish("finished")
+	m.ExecStatus = StatusExecFailed
+	m.PublishError(&tailError{errors.New("failed")})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d: %q", len(lines), buf.String())
+	}
+	msgs := []*JSONMessage{}
+	for _, l := range lines {
+		j := &JSONMessage{}
+		if err := json.Unmarshal([]byte(l), j); err != nil {
+			t.Fatalf("expected line %q to be valid JSON: %s", l, err)
+		}
+		msgs = append(msgs, j)
+	}
+	if j := msgs[0]; j.Version != JSONLogVersion || j.Key != MessageTasksProvisionTask+".finished" || j.Hostname != "host" || j.TaskName != "base" || j.TaskChecksum != "abc" || j.ExecStatus != StatusExecFinished {
+		t.Errorf("unexpected message %#v", j)
+	}
+	if j := msgs[0]; j.Duration < 1 || j.Error != "" {
+		t.Errorf("expected duration of at least a second and no error, got %#v", j)
+	}
+	if j := msgs[1]; j.Error != "failed" || strings.Join(j.StderrTail, ",") != "first,second" {
+		t.Errorf("expected error with stderr tail, got %#v", j)
+	}
+	if !strings.Contains(lines[0], `"version":1,"key":`) || strings.Contains(lines[0], `"error"`) {
+		t.Errorf("unexpected schema %s", lines[0])
+	}
+}
+
+func TestJSONFormatterEncodingError(t *testing.T) {
+	m := &Message{Key: MessageBuildReport + ".finished", Hostname: "host", Report: map[string]interface{}{"broken": func() {}}}
+	line := JSONFormatter(m)
+	j := &JSONMessage{}
+	if err := json.Unmarshal([]byte(line), j); err != nil {
+		t.Fatalf("expected line %q to be valid JSON: %s", line, err)
+	}
+	if j.Key != m.Key || j.Hostname != "host" || j.Report != nil || !strings.Contains(j.EncodingError, "unsupported type") {
+		t.Errorf("expected message without report and the encoding error, got %#v", j)
+	}
+}
@@ -2,35 +2,24 @@ package pubsub
 
 import (
 	"runtime"
-	"sync"
 	"time"
 
 	"github.com/dynport/dgtk/pubsub"
 )
 
-var pubSub = []*pubsub.PubSub{}
-var mutex = &sync.Mutex{}
-
 // Register your own instance of the PubSub type to handle logging yourself.
+// The instance is subscribed to the default events, that are used by all
+// builds without events of their own.
 func RegisterPubSub(ps *pubsub.PubSub) {
-	mutex.Lock()
-	pubSub = append(pubSub, ps)
-	mutex.Unlock()
-}
-
-func publish(i interface{}) (e error) {
-	for _, ps := range pubSub {
-		if e = ps.Publish(i); e != nil {
-			return e
-		}
-	}
-	return nil
+	defaultEvents.Subscribe(ps)
 }
 
 const (
 	StatusCached       = "CACHED"
 	StatusExecStart    = "EXEC"
 	StatusExecFinished = "FINISHED"
+	StatusExecFailed   = "FAILED"
+	StatusRollback     = "ROLLBACK"
 )
 
 const (
@@ -39,6 +28,19 @@ const (
 	MessageCleanupCacheEntries = "urknall.cleanup_cache_entries"
 	MessageTasksProvision      = "urknall.tasks.provision.list"
 	MessageTasksProvisionTask  = "urknall.tasks.provision.task"
+	MessageTasksRollback       = "urknall.tasks.rollback"
+)
+
+// Keys of the messages published while a build is running. The messages are
+// published with the postfixes "started", "finished" and "error" (and "cached"
+// for tasks without pending commands). The durations of finished messages are
+// measured from the start of the build, task or command.
+const (
+	MessageBuild         = "urknall.build"
+	MessageTask          = "urknall.task"
+	MessageCommand       = "urknall.command"
+	MessageCommandOutput = "urknall.command.output" // A line of a command's output (postfix "line").
+	MessageBuildReport   = "urknall.report"         // The summary of a finished build (postfix "finished").
 )
 
 // Urknall uses the http://github.com/dynport/dgtk/pubsub package for logging (a publisher-subscriber pattern where
@@ -66,8 +68,12 @@ type Message struct {
 
 	InvalidatedCacheEntries []string // List of invalidated cache entries (urknall caching).
 
+	Report interface{} // The report of a build (for messages with key MessageBuildReport).
+
 	Error error  // Error that occured.
 	Stack string // The stack trace in case of a panic.
+
+	events *Events // where the message is published (the default events if nil)
 }
 
 // Predicated to verify whether the given message was sent via stderr.
@@ -106,5 +112,9 @@ func (message Message) Publish(key string) {
 		message.Duration = message.PublishedAt.Sub(message.StartedAt)
 	}
 
-	publish(&message)
+	events := message.events
+	if events == nil {
+		events = defaultEvents
+	}
+	events.Publish(&message)
 }
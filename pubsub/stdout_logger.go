@@ -14,34 +14,54 @@ const (
 	colorDryRun = 226
 	colorCached = 33
 	colorExec   = 34
+	colorFailed = 196
+	colorUndo   = 208
 )
 
 var colorMapping = map[string]int{
 	StatusCached:       colorCached,
 	StatusExecFinished: colorExec,
+	StatusExecFailed:   colorFailed,
+	StatusRollback:     colorUndo,
 }
 
 var ignoredMessagesError = errors.New("ignored published messages (subscriber buffer full)")
 
-// Create a logging facility for urknall using urknall's default formatter.
-// Note that this resource must be closed afterwards!
-func OpenLogger(w io.Writer) io.Closer {
+// Options are used to configure loggers.
+type LoggerOption func(*logger)
+
+// Create a logging facility for urknall using urknall's default formatter
+// (unless configured otherwise using the given options). Note that this
+// resource must be closed afterwards!
+func OpenLogger(w io.Writer, opts ...LoggerOption) io.Closer {
 	logger := &logger{}
 	logger.Output = w
 	logger.Formatter = logger.DefaultFormatter
+	for _, o := range opts {
+		o(logger)
+	}
 	// Ignore the error from Start. It would only be triggered if the formatter wouldn't be set.
 	_ = logger.Start()
 	return logger
 }
 
+// Subscribe the logger to the given events instead of the default events.
+func WithEvents(e *Events) LoggerOption {
+	return func(l *logger) {
+		l.events = e
+	}
+}
+
 type logger struct {
 	Output       io.Writer
 	Formatter    formatter
 	maxLengths   map[int]int
 	started      time.Time
 	finished     chan interface{}
+	events       *Events
 	pubSub       *pubsub.PubSub
 	subscription *pubsub.Subscription
+	unsubscribe  func()
 }
 
 func (logger *logger) Started() time.Time {
@@ -73,6 +93,18 @@ func (logger *logger) DefaultFormatter(message *Message) string {
 			return ""
 		}
 	}
+	if strings.HasPrefix(message.Key, MessageBuildReport+".") {
+		return message.Message
+	}
+	// Of the build's progress the started and failed commands are logged, as
+	// well as their output.
+	switch {
+	case message.Key == MessageCommandOutput+".line":
+		return logger.formatCommandOuput(message)
+	case message.Key == MessageCommand+".started", message.Key == MessageCommand+".error":
+	case strings.HasPrefix(message.Key, MessageBuild+"."), strings.HasPrefix(message.Key, MessageTask+"."), strings.HasPrefix(message.Key, MessageCommand+"."):
+		return ""
+	}
 	if len(message.Line) > 0 {
 		return logger.formatCommandOuput(message)
 	}
@@ -82,6 +114,9 @@ func (logger *logger) DefaultFormatter(message *Message) string {
 	if message.Message != "" {
 		payload = message.Message
 	}
+	if message.Error != nil {
+		payload = message.Error.Error()
+	}
 	execStatus := fmt.Sprintf("%-8s", message.ExecStatus)
 	if color := colorMapping[message.ExecStatus]; color > 0 {
 		execStatus = colorize(color, execStatus)
@@ -95,7 +130,13 @@ func (logger *logger) DefaultFormatter(message *Message) string {
 			payload,
 		),
 	}
-	return strings.Join(parts, " ")
+	// Errors of failed commands carry the last lines of standard error.
+	if e, ok := message.Error.(interface{ StderrTail() []string }); ok {
+		for _, l := range e.StderrTail() {
+			parts = append(parts, "    "+colorize(1, l))
+		}
+	}
+	return strings.Join(parts, "\n")
 }
 
 func formatTaskName(name string, maxLen int) string {
@@ -122,8 +163,11 @@ func (logger *logger) Start() error {
 	if logger.Formatter == nil {
 		return fmt.Errorf("Formatter must be set")
 	}
+	if logger.events == nil {
+		logger.events = defaultEvents
+	}
 	logger.pubSub = pubsub.New()
-	RegisterPubSub(logger.pubSub)
+	logger.unsubscribe = logger.events.Subscribe(logger.pubSub)
 	logger.subscription = logger.pubSub.Subscribe(func(m *Message) {
 		if message := logger.Formatter(m); message != "" {
 			fmt.Fprintln(logger.Output, message)
@@ -133,6 +177,7 @@ func (logger *logger) Start() error {
 }
 
 func (logger *logger) Close() (e error) {
+	logger.unsubscribe()
 	e = logger.subscription.Close()
 	if d := logger.pubSub.Stats.Ignored(); e == nil && d > 0 {
 		return ignoredMessagesError
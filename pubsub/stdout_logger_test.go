@@ -0,0 +1,48 @@
+package pubsub
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDefaultFormatter(t *testing.T) {
+	l := &logger{}
+	tests := []struct {
+		Key      string
+		Message  *Message
+		Expected string
+	}{
+		{MessageCommand + ".started", &Message{ExecStatus: StatusExecStart, Message: "echo hello"}, "echo hello"},
+		{MessageCommandOutput + ".line", &Message{Stream: "stdout", Line: "hello"}, "hello"},
+		{MessageCommand + ".finished", &Message{ExecStatus: StatusExecFinished, Message: "echo hello"}, ""},
+		{MessageTask + ".finished", &Message{ExecStatus: StatusExecFinished}, ""},
+		{MessageBuild + ".started", &Message{}, ""},
+	}
+	for _, tc := range tests {
+		tc.Message.Key = tc.Key
+		tc.Message.Hostname = "host"
+		tc.Message.TaskName = "base"
+		v := l.DefaultFormatter(tc.Message)
+		switch {
+		case tc.Expected == "" && v != "":
+			t.Errorf("%s: expected message to be ignored, got %q", tc.Key, v)
+		case !strings.Contains(v, tc.Expected) || (tc.Expected != "" && !strings.Contains(v, "base")):
+			t.Errorf("%s: expected %q to contain %q", tc.Key, v, tc.Expected)
+		}
+	}
+
+	// Output is only written by loggers.
+	buf := &bytes.Buffer{}
+	events := NewEvents()
+	logger := OpenLogger(buf, WithEvents(events))
+	m := events.NewMessage(MessageCommandOutput)
+	m.Line = "hello"
+	m.Publish("line")
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), " hello\n") {
+		t.Errorf("expected output line to be logged, got %q", buf.String())
+	}
+}
@@ -0,0 +1,78 @@
+package urknall
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dynport/urknall/target"
+)
+
+// Time waited between checks whether a target returned after a reboot.
+var rebootPollInterval = 5 * time.Second
+
+const bootIDCmd = "cat /proc/sys/kernel/random/boot_id"
+
+// A reboot is detected by a change of the target's boot id. The reboot
+// command is recorded as executed only once the target returned, so that
+// reboots that didn't happen are retried with the next build.
+func (b *Build) reboot(ctx context.Context, t *TaskPlan, c *CommandPlan, timeout time.Duration) error {
+	id, err := bootID(b.Target)
+	if err != nil {
+		return fmt.Errorf("reading boot id: %s", err)
+	}
+	// Errors are expected, as the connection might be lost while the command
+	// is running.
+	if _, err := b.exec(ctx, t, c); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if err := waitForReboot(ctx, b.Target, id, timeout); err != nil {
+		return err
+	}
+	return b.record(t, c, false, nil)
+}
+
+// Errors reaching the target are expected while it is rebooting, so the target
+// is polled until the deadline. The last error is reported on timeout.
+func waitForReboot(ctx context.Context, t Target, id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var last error
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if last != nil {
+				return fmt.Errorf("%s did not return within %s after reboot: %s", t, timeout, last)
+			}
+			return fmt.Errorf("%s did not return within %s after reboot", t, timeout)
+		}
+		if w, ok := t.(target.Waiter); ok {
+			last = w.WaitUntilReachable(remaining)
+		} else {
+			last = t.Reset()
+		}
+		if last == nil {
+			var current string
+			if current, last = bootID(t); last == nil && current != id {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(rebootPollInterval):
+		}
+	}
+}
+
+func bootID(t Target) (string, error) {
+	b, err := capture(t, bootIDCmd)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,138 @@
+package urknall
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dynport/urknall/target"
+)
+
+type rebootCommand struct {
+	timeout time.Duration
+}
+
+func (c *rebootCommand) Shell() string                { return "reboot now" }
+func (c *rebootCommand) RebootTimeout() time.Duration { return c.timeout }
+
+// A target simulating a reboot: the boot id changes with the given number of
+// resets after the reboot command was run. The given number of resets fail
+// while rebooting.
+type rebootTarget struct {
+	resetsNeeded int
+	resetsFailed int
+
+	mutex     sync.Mutex
+	bootID    int
+	rebooting bool
+	resets    int
+	commands  []string
+}
+
+func (t *rebootTarget) Command(cmd string) (target.ExecCommand, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if cmd == bootIDCmd {
+		return target.NewLocalTarget().Command(fmt.Sprintf("echo boot-%d", t.bootID))
+	}
+	if strings.Contains(cmd, "reboot now") {
+		t.rebooting = true
+		t.commands = append(t.commands, "reboot")
+	} else {
+		t.commands = append(t.commands, "other")
+	}
+	return target.NewLocalTarget().Command("true")
+}
+
+func (t *rebootTarget) Reset() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.rebooting {
+		if t.resets++; t.resets <= t.resetsFailed {
+			return fmt.Errorf("connection refused")
+		}
+		if t.resets >= t.resetsNeeded {
+			t.bootID++
+			t.rebooting = false
+		}
+	}
+	return nil
+}
+
+func (t *rebootTarget) User() string   { return "root" }
+func (t *rebootTarget) String() string { return "reboot" }
+
+func TestReboot(t *testing.T) {
+	interval := rebootPollInterval
+	rebootPollInterval = 10 * time.Millisecond
+	defer func() { rebootPollInterval = interval }()
+
+	dir, err := ioutil.TempDir("", "urknall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tg := &rebootTarget{resetsNeeded: 3, resetsFailed: 2}
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("kernel", Shell("echo before"), &rebootCommand{timeout: time.Second}, Shell("echo after"))
+	})
+	b := &Build{Target: tg, Template: tpl, State: NewLocalStateStore(dir)}
+	if err := b.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v := strings.Join(tg.commands, ","); v != "other,reboot,other" {
+		t.Errorf("expected commands to be %q, got %q", "other,reboot,other", v)
+	}
+	if tg.bootID != 1 {
+		t.Errorf("expected target to be rebooted once, got %d", tg.bootID)
+	}
+
+	// The reboot was recorded, so nothing is pending.
+	p, err := b.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Pending(); n != 0 {
+		t.Errorf("expected no pending commands, got %d", n)
+	}
+}
+
+func TestRebootTimeout(t *testing.T) {
+	interval := rebootPollInterval
+	rebootPollInterval = 10 * time.Millisecond
+	defer func() { rebootPollInterval = interval }()
+
+	dir, err := ioutil.TempDir("", "urknall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tg := &rebootTarget{resetsNeeded: 1000}
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("kernel", &rebootCommand{timeout: 100 * time.Millisecond}, Shell("echo after"))
+	})
+	b := &Build{Target: tg, Template: tpl, State: NewLocalStateStore(dir)}
+	err = b.RunContext(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "did not return") {
+		t.Errorf("expected reboot to time out, got %v", err)
+	}
+	if v := strings.Join(tg.commands, ","); v != "reboot" {
+		t.Errorf("expected commands to be %q, got %q", "reboot", v)
+	}
+
+	// The reboot wasn't recorded, so it is retried.
+	p, err := b.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Pending(); n != 2 {
+		t.Errorf("expected 2 pending commands, got %d", n)
+	}
+}
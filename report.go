@@ -0,0 +1,351 @@
+package urknall
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dynport/urknall/pubsub"
+)
+
+// Status of tasks and commands in a build report.
+const (
+	ReportCached   = "cached"   // Executed in an earlier build.
+	ReportExecuted = "executed" // Executed successfully.
+	ReportFailed   = "failed"   // Failed (the build was stopped).
+	ReportSkipped  = "skipped"  // Not run, as the build was stopped before.
+)
+
+// The summary of a build: the tasks and commands with their status and how
+// long they took. Tasks and commands are sorted by duration (slowest first).
+// Durations are given in seconds when exported as JSON.
+type BuildReport struct {
+	Host     string        `json:"host"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	Tasks    []*TaskReport `json:"tasks"`
+}
+
+// The report of a single task.
+type TaskReport struct {
+	Name     string           `json:"name"`
+	Status   string           `json:"status"`
+	Duration time.Duration    `json:"duration"`
+	Commands []*CommandReport `json:"commands"`
+}
+
+// The report of a single command.
+type CommandReport struct {
+	Checksum string        `json:"checksum"`
+	Command  string        `json:"command"` // Log message of the command.
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Like RunContext, but a report of the build is returned (even if the build
+// failed). The report is also published, so that it is printed by loggers.
+func (b *Build) RunWithReport(ctx context.Context) (*BuildReport, error) {
+	orig := b.Events
+	defer func() { b.Events = orig }()
+	parent := orig
+	if parent == nil {
+		parent = pubsub.DefaultEvents()
+	}
+	// The collector gets the messages first, they are then passed on to the
+	// build's events.
+	c := &reportCollector{report: &BuildReport{Host: b.hostname()}, tasks: map[string]*TaskReport{}}
+	origExecutor := b.Executor
+	defer func() { b.Executor = origExecutor }()
+	ex := origExecutor
+	if ex == nil {
+		ex = &RunExecutor{}
+	}
+	b.Executor = &reportExecutor{Executor: ex, collector: c}
+	b.Events = pubsub.NewEvents()
+	b.Events.Subscribe(c)
+	b.Events.Subscribe(pubsub.SinkFunc(func(m *pubsub.Message) {
+		parent.Publish(m)
+	}))
+
+	err := b.RunContext(ctx)
+	r := c.build()
+	m := b.message(pubsub.MessageBuildReport, "")
+	m.Message = r.String()
+	m.Report = r
+	m.Publish("finished")
+	return r, err
+}
+
+// Number of commands executed successfully.
+func (r *BuildReport) Executed() int {
+	return r.count(ReportExecuted)
+}
+
+// Number of cached commands.
+func (r *BuildReport) Cached() int {
+	return r.count(ReportCached)
+}
+
+// Number of failed commands.
+func (r *BuildReport) Failed() int {
+	return r.count(ReportFailed)
+}
+
+// Number of commands not run.
+func (r *BuildReport) Skipped() int {
+	return r.count(ReportSkipped)
+}
+
+func (r *BuildReport) count(status string) (n int) {
+	for _, t := range r.Tasks {
+		for _, c := range t.Commands {
+			if c.Status == status {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// A summary line followed by the executed tasks and commands.
+func (r *BuildReport) String() string {
+	lines := []string{fmt.Sprintf("%s: %d tasks, %d commands executed, %d cached, %d failed, %d skipped in %.3fs",
+		r.Host, len(r.Tasks), r.Executed(), r.Cached(), r.Failed(), r.Skipped(), r.Duration.Seconds())}
+	for _, t := range r.Tasks {
+		if t.Status == ReportCached {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("  %8.3fs %-8s %s", t.Duration.Seconds(), t.Status, t.Name))
+		for _, c := range t.Commands {
+			if c.Status != ReportCached {
+				lines = append(lines, fmt.Sprintf("    %8.3fs %-8s %s", c.Duration.Seconds(), c.Status, c.Command))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *BuildReport) MarshalJSON() ([]byte, error) {
+	type plain BuildReport
+	return json.Marshal(struct {
+		*plain
+		Duration float64 `json:"duration"`
+	}{(*plain)(r), r.Duration.Seconds()})
+}
+
+func (r *TaskReport) MarshalJSON() ([]byte, error) {
+	type plain TaskReport
+	return json.Marshal(struct {
+		*plain
+		Duration float64 `json:"duration"`
+	}{(*plain)(r), r.Duration.Seconds()})
+}
+
+func (r *CommandReport) MarshalJSON() ([]byte, error) {
+	type plain CommandReport
+	return json.Marshal(struct {
+		*plain
+		Duration float64 `json:"duration"`
+	}{(*plain)(r), r.Duration.Seconds()})
+}
+
+// Write the report as JSON.
+func (r *BuildReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+type junitSuites struct {
+	XMLName xml.Name      `xml:"testsuites"`
+	Name    string        `xml:"name,attr"`
+	Tests   int           `xml:"tests,attr"`
+	Fails   int           `xml:"failures,attr"`
+	Skipped int           `xml:"skipped,attr"`
+	Time    string        `xml:"time,attr"`
+	Suites  []*junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name    string       `xml:"name,attr"`
+	Tests   int          `xml:"tests,attr"`
+	Fails   int          `xml:"failures,attr"`
+	Skipped int          `xml:"skipped,attr"`
+	Time    string       `xml:"time,attr"`
+	Cases   []*junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+// Write the report in the JUnit XML format: the host is a set of test suites
+// with a suite per task and a test case per command. Cached commands and
+// commands not run are reported as skipped.
+func (r *BuildReport) WriteJUnit(w io.Writer) error {
+	seconds := func(d time.Duration) string { return fmt.Sprintf("%.3f", d.Seconds()) }
+	suites := &junitSuites{Name: r.Host, Time: seconds(r.Duration)}
+	for _, t := range r.Tasks {
+		s := &junitSuite{Name: r.Host + "." + t.Name, Time: seconds(t.Duration)}
+		for _, c := range t.Commands {
+			tc := &junitCase{Name: c.Command, ClassName: r.Host + "." + t.Name, Time: seconds(c.Duration)}
+			switch c.Status {
+			case ReportFailed:
+				tc.Failure = &junitFailure{Message: c.Error}
+				s.Fails++
+			case ReportCached, ReportSkipped:
+				tc.Skipped = &struct{}{}
+				s.Skipped++
+			}
+			s.Cases = append(s.Cases, tc)
+			s.Tests++
+		}
+		suites.Tests += s.Tests
+		suites.Fails += s.Fails
+		suites.Skipped += s.Skipped
+		suites.Suites = append(suites.Suites, s)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// The executor passing the plan to the collector before carrying it out.
+type reportExecutor struct {
+	Executor
+	collector *reportCollector
+}
+
+func (ex *reportExecutor) Execute(ctx context.Context, b *Build, p *Plan) error {
+	ex.collector.plan(p)
+	return ex.Executor.Execute(ctx, b, p)
+}
+
+// The report is built from the plan and the messages published by the build.
+// Tasks and commands of the plan are skipped until a message is received.
+type reportCollector struct {
+	mutex  sync.Mutex
+	report *BuildReport
+	tasks  map[string]*TaskReport
+}
+
+func (c *reportCollector) plan(p *Plan) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, tp := range p.Tasks {
+		if tp.Orphaned {
+			continue
+		}
+		t := c.task(tp.Name)
+		for _, cp := range tp.Commands {
+			t.Commands = append(t.Commands, &CommandReport{Checksum: cp.Checksum, Command: cp.LogMsg, Status: ReportSkipped})
+		}
+	}
+}
+
+func (c *reportCollector) task(name string) *TaskReport {
+	t, ok := c.tasks[name]
+	if !ok {
+		t = &TaskReport{Name: name, Status: ReportSkipped, Commands: []*CommandReport{}}
+		c.tasks[name] = t
+		c.report.Tasks = append(c.report.Tasks, t)
+	}
+	return t
+}
+
+// The planned command not reported yet (added if not planned).
+func (c *reportCollector) command(m *pubsub.Message) *CommandReport {
+	t := c.task(m.TaskName)
+	for _, cr := range t.Commands {
+		if cr.Checksum == m.TaskChecksum && cr.Status == ReportSkipped {
+			return cr
+		}
+	}
+	cr := &CommandReport{Checksum: m.TaskChecksum, Command: m.Message}
+	t.Commands = append(t.Commands, cr)
+	return cr
+}
+
+func (c *reportCollector) Publish(i interface{}) error {
+	m, ok := i.(*pubsub.Message)
+	if !ok {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	errorText := ""
+	if m.Error != nil {
+		errorText = m.Error.Error()
+	}
+	switch m.Key {
+	case pubsub.MessageBuild + ".started":
+		c.report.Started = m.StartedAt
+	case pubsub.MessageBuild + ".finished", pubsub.MessageBuild + ".error":
+		c.report.Duration = m.Duration
+		c.report.Error = errorText
+	case pubsub.MessageTask + ".cached":
+		c.task(m.TaskName).Status = ReportCached
+	case pubsub.MessageTask + ".finished":
+		t := c.task(m.TaskName)
+		t.Status, t.Duration = ReportExecuted, m.Duration
+	case pubsub.MessageTask + ".error":
+		t := c.task(m.TaskName)
+		t.Status, t.Duration = ReportFailed, m.Duration
+	case pubsub.MessageCommand + ".cached":
+		c.command(m).Status = ReportCached
+	case pubsub.MessageCommand + ".finished":
+		cr := c.command(m)
+		cr.Status, cr.Duration = ReportExecuted, m.Duration
+	case pubsub.MessageCommand + ".error":
+		cr := c.command(m)
+		cr.Status, cr.Duration, cr.Error = ReportFailed, m.Duration, errorText
+	}
+	return nil
+}
+
+// The report with tasks and commands sorted by duration.
+func (c *reportCollector) build() *BuildReport {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	r := c.report
+	for _, t := range r.Tasks {
+		sort.Stable(commandReports(t.Commands))
+	}
+	sort.Stable(taskReports(r.Tasks))
+	return r
+}
+
+type taskReports []*TaskReport
+
+func (r taskReports) Len() int           { return len(r) }
+func (r taskReports) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r taskReports) Less(i, j int) bool { return r[i].Duration > r[j].Duration }
+
+type commandReports []*CommandReport
+
+func (r commandReports) Len() int           { return len(r) }
+func (r commandReports) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r commandReports) Less(i, j int) bool { return r[i].Duration > r[j].Duration }
@@ -0,0 +1,139 @@
+package urknall
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/dynport/urknall/pubsub"
+	"github.com/dynport/urknall/target"
+)
+
+func TestBuildReport(t *testing.T) {
+	published := []*pubsub.Message{}
+	events := pubsub.NewEvents()
+	events.Subscribe(pubsub.SinkFunc(func(m *pubsub.Message) {
+		if m.Key == pubsub.MessageBuildReport+".finished" {
+			published = append(published, m)
+		}
+	}))
+
+	fail := "true"
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base", Shell("true"))
+		p.AddCommands("app", Shell("true"), Shell("sleep 0.1"), Shell(fail))
+	})
+	b := &Build{Target: target.NewLocalTarget(), Template: tpl, State: NewMemoryStateStore(), Events: events}
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	fail = "false"
+	r, err := b.RunWithReport(context.Background())
+	if err == nil {
+		t.Fatal("expected build to fail")
+	}
+	if b.Events != events {
+		t.Errorf("expected events of the build to be restored")
+	}
+	if len(published) != 1 || published[0].Report != r {
+		t.Errorf("expected report to be published")
+	}
+	if v, ex := []int{len(r.Tasks), r.Executed(), r.Cached(), r.Failed()}, []int{2, 0, 3, 1}; v[0] != ex[0] || v[1] != ex[1] || v[2] != ex[2] || v[3] != ex[3] {
+		t.Errorf("expected tasks, executed, cached and failed to be %v, got %v", ex, v)
+	}
+	if r.Tasks[0].Name != "app" || r.Tasks[0].Status != ReportFailed || r.Tasks[1].Status != ReportCached {
+		t.Errorf("expected failed task first, got %q (%s) and %q (%s)", r.Tasks[0].Name, r.Tasks[0].Status, r.Tasks[1].Name, r.Tasks[1].Status)
+	}
+	if c := r.Tasks[0].Commands[0]; c.Status != ReportFailed || !strings.Contains(c.Error, "exit code 1") {
+		t.Errorf("expected failed command first, got %#v", c)
+	}
+	if !strings.HasPrefix(r.String(), "LOCAL: 2 tasks, 0 commands executed, 3 cached, 1 failed, 0 skipped in ") {
+		t.Errorf("unexpected summary %q", r.String())
+	}
+
+	fail = "sleep 0.2"
+	r, err = b.RunWithReport(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := r.Executed(); v != 1 {
+		t.Errorf("expected 1 executed command, got %d", v)
+	}
+	if c := r.Tasks[0].Commands[0]; c.Command != "sleep 0.2" || c.Duration.Seconds() < 0.2 {
+		t.Errorf("expected slowest command first, got %#v", c)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := r.WriteJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+	parsed := struct {
+		Host     string
+		Duration float64
+		Tasks    []struct {
+			Name     string
+			Duration float64
+			Commands []struct {
+				Status   string
+				Duration float64
+			}
+		}
+	}{}
+	if err := json.Unmarshal(buf.Bytes(), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Host != "LOCAL" || parsed.Duration < 0.2 || len(parsed.Tasks) != 2 || parsed.Tasks[0].Commands[0].Duration < 0.2 {
+		t.Errorf("unexpected JSON report %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := r.WriteJUnit(buf); err != nil {
+		t.Fatal(err)
+	}
+	junit := &junitSuites{}
+	if err := xml.Unmarshal(buf.Bytes(), junit); err != nil {
+		t.Fatal(err)
+	}
+	if junit.Tests != 4 || junit.Skipped != 3 || junit.Fails != 0 || len(junit.Suites) != 2 || junit.Suites[0].Name != "LOCAL.app" {
+		t.Errorf("unexpected JUnit report %s", buf.String())
+	}
+}
+
+func TestBuildReportSkipped(t *testing.T) {
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("a", Shell("true"), Shell("false"), Shell("echo a"))
+		p.AddCommands("b", Shell("echo b"))
+	})
+	b := &Build{Target: target.NewLocalTarget(), Template: tpl, State: NewMemoryStateStore(), Events: pubsub.NewEvents()}
+	r, err := b.RunWithReport(context.Background())
+	if err == nil {
+		t.Fatal("expected build to fail")
+	}
+	if b.Executor != nil {
+		t.Errorf("expected executor of the build to be restored")
+	}
+	if v, ex := []int{len(r.Tasks), r.Executed(), r.Cached(), r.Failed(), r.Skipped()}, []int{2, 1, 0, 1, 2}; v[0] != ex[0] || v[1] != ex[1] || v[2] != ex[2] || v[3] != ex[3] || v[4] != ex[4] {
+		t.Errorf("expected tasks, executed, cached, failed and skipped to be %v, got %v", ex, v)
+	}
+	for _, tr := range r.Tasks {
+		if tr.Name == "b" && (tr.Status != ReportSkipped || len(tr.Commands) != 1 || tr.Commands[0].Command != "echo b") {
+			t.Errorf("expected task b to be skipped with its command, got %s %v", tr.Status, tr.Commands)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := r.WriteJUnit(buf); err != nil {
+		t.Fatal(err)
+	}
+	junit := &junitSuites{}
+	if err := xml.Unmarshal(buf.Bytes(), junit); err != nil {
+		t.Fatal(err)
+	}
+	if junit.Tests != 4 || junit.Skipped != 2 || junit.Fails != 1 {
+		t.Errorf("unexpected JUnit report %s", buf.String())
+	}
+}
@@ -0,0 +1,71 @@
+package urknall
+
+import (
+	"context"
+
+	"github.com/dynport/urknall/cmd"
+	"github.com/dynport/urknall/pubsub"
+)
+
+// Undo the commands of the failed task executed in this build (newest first)
+// and run the task's failure hooks. The undone commands are executed again with
+// the next build. Nothing is done if the build was aborted.
+func (b *Build) rollback(ctx context.Context, t *TaskPlan, failed *CommandPlan) {
+	if ctx.Err() != nil {
+		return
+	}
+	steps := []*RollbackStep{}
+	keep := failed.Index
+	executed := b.executed[t]
+	for i := len(executed) - 1; i >= 0; i-- {
+		c := executed[i]
+		u, ok := c.command.command.(cmd.Undoer)
+		if !ok || u.Undo() == nil {
+			continue
+		}
+		steps = append(steps, b.rollbackStep(ctx, t, c.Index, u.Undo(), false))
+		if c.Index < keep {
+			keep = c.Index
+		}
+	}
+	for _, h := range t.onFailure {
+		steps = append(steps, b.rollbackStep(ctx, t, failed.Index, h.command, true))
+	}
+	if len(steps) == 0 {
+		return
+	}
+	checksums := []string{}
+	if keep > 0 {
+		checksums = t.checksums(keep - 1)
+	}
+	r := &RollbackRecord{Task: t.Name, Run: b.runID, Checksums: checksums, Steps: steps}
+	if err := b.stateStore().RecordRollback(b.Target, r); err != nil {
+		logError(err)
+		return
+	}
+	if keep < failed.Index {
+		m := b.message(pubsub.MessageCleanupCacheEntries, t.Name)
+		for _, c := range t.Commands[keep:failed.Index] {
+			m.InvalidatedCacheEntries = append(m.InvalidatedCacheEntries, c.Checksum)
+		}
+		m.Publish("finished")
+	}
+}
+
+// Failing steps don't stop the rollback, all remaining steps are run.
+func (b *Build) rollbackStep(ctx context.Context, t *TaskPlan, index int, c cmd.Command, hook bool) *RollbackStep {
+	w := &commandWrapper{command: c}
+	p := &CommandPlan{Index: index, Checksum: w.Checksum(), LogMsg: b.secrets.mask(w.LogMsg()), Content: b.secrets.maskShell(c.Shell()), command: w}
+	step := &RollbackStep{Command: p.LogMsg, Hook: hook}
+	m := b.message(pubsub.MessageTasksRollback, t.Name)
+	m.TaskChecksum = p.Checksum
+	m.Message = p.LogMsg
+	m.ExecStatus = pubsub.StatusRollback
+	if _, err := b.exec(ctx, t, p); err != nil {
+		step.Failed = true
+		m.PublishError(err)
+	} else {
+		m.Publish("finished")
+	}
+	return step
+}
@@ -0,0 +1,117 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dynport/urknall/cmd"
+	"github.com/dynport/urknall/target"
+)
+
+type undoCommand struct {
+	*testCommand
+	undo string
+}
+
+func (c *undoCommand) Undo() cmd.Command {
+	return &testCommand{cmd: c.undo}
+}
+
+func TestRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+	exists := func(name string) bool {
+		_, err := os.Stat(file(name))
+		return err == nil
+	}
+
+	last := "false"
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("cached", Shell("true"))
+		p.AddTask("app", OnFailure(NewTask().Add(
+			&undoCommand{testCommand: &testCommand{cmd: "touch " + file("a")}, undo: "rm " + file("a")},
+			"touch "+file("plain"),
+			&undoCommand{testCommand: &testCommand{cmd: "touch " + file("b")}, undo: "rm " + file("b") + " && false"},
+			last,
+		), "touch "+file("hook")))
+	})
+	b := &Build{Target: target.NewLocalTarget(), Template: tpl, State: NewLocalStateStore(filepath.Join(dir, "state"))}
+	if err := b.Run(); err == nil {
+		t.Fatal("expected build to fail")
+	}
+	for name, ex := range map[string]bool{"a": false, "b": false, "plain": true, "hook": true} {
+		if v := exists(name); v != ex {
+			t.Errorf("expected existence of %q to be %t, was %t", name, ex, v)
+		}
+	}
+
+	runs, err := b.stateStore().ListRuns(b.Target, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("expected 1 run, got %d", len(runs))
+	}
+	steps := []string{}
+	for _, s := range runs[0].Rollback {
+		steps = append(steps, strings.TrimPrefix(s.String(), rollbackPrefix))
+	}
+	ex := "undo failed rm " + file("b") + " && false," +
+		"undo ok rm " + file("a") + "," +
+		"hook ok [COMMAND] touch " + file("hook")
+	if v := strings.Join(steps, ","); v != ex {
+		t.Errorf("expected rollback steps\n%s\ngot\n%s", ex, v)
+	}
+	if len(runs[0].Done) != 0 {
+		t.Errorf("expected undone commands not to be done, got %v", runs[0].Done)
+	}
+
+	// All undone commands are executed again.
+	last = "true"
+	b.Template = tpl
+	p, err := b.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := p.Pending(); v != 4 {
+		t.Errorf("expected 4 pending commands, got %d", v)
+	}
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("a") || !exists("b") {
+		t.Errorf("expected commands to be executed again")
+	}
+}
+
+func TestRollbackFiles(t *testing.T) {
+	r := &RollbackRecord{
+		Task:      "app",
+		Run:       "20150102_030405",
+		Checksums: []string{"aa"},
+		Steps:     []*RollbackStep{{Command: "rm\n-rf  /tmp/x"}, {Command: "notify", Hook: true, Failed: true}},
+	}
+	files := rollbackFiles("/var/lib/urknall", r)
+	run := files["app/20150102_030405.run"]
+	ex := "/var/lib/urknall/app/aa.done\n# rollback undo ok rm -rf /tmp/x\n# rollback hook failed notify\n"
+	if v := string(run); v != ex {
+		t.Errorf("expected run file %q, got %q", ex, v)
+	}
+	if v := string(files["app/build.20150102_030405/20150102_030405.run"]); v != ex {
+		t.Errorf("expected build's run file %q, got %q", ex, v)
+	}
+	if v := strings.Join(parseRunFile(run), ","); v != "aa" {
+		t.Errorf("expected checksums %q, got %q", "aa", v)
+	}
+	steps := parseRollback(run)
+	if len(steps) != 2 || steps[0].Command != "rm -rf /tmp/x" || steps[0].Hook || steps[0].Failed || steps[1].Command != "notify" || !steps[1].Hook || !steps[1].Failed {
+		t.Errorf("unexpected rollback steps %v", steps)
+	}
+}
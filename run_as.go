@@ -0,0 +1,69 @@
+package urknall
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/dynport/urknall/cmd"
+)
+
+var userNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_.-]*\$?$`)
+
+// The user the command must be run as (empty if not given).
+func runAsUser(c cmd.Command) string {
+	if u, ok := c.(cmd.UserSwitcher); ok {
+		return u.RunAs()
+	}
+	return ""
+}
+
+// Targets running all commands as a fixed user (like local targets created
+// with target.WithRunAsUser) implement the runAsTarget interface.
+type runAsTarget interface {
+	RunAs() string
+}
+
+// The user the target runs all commands as (empty if not fixed).
+func targetRunAs(t Target) string {
+	if r, ok := t.(runAsTarget); ok {
+		return r.RunAs()
+	}
+	return ""
+}
+
+// Commands run as a user must use a valid user name. Rebooting requires root,
+// so reboot commands can't be run as another user. If the target runs all
+// commands as a user other than root (the outer user), commands can't be run
+// as another user.
+func checkRunAs(outer string, c cmd.Command) error {
+	u := runAsUser(c)
+	if u == "" {
+		return nil
+	}
+	if !userNameRegexp.MatchString(u) {
+		return fmt.Errorf("invalid user name %q", u)
+	}
+	if _, ok := c.(cmd.Rebooter); ok && u != "root" {
+		return fmt.Errorf("reboot commands can't be run as user %q", u)
+	}
+	if outer != "" && outer != "root" && u != outer {
+		return fmt.Errorf("command can't be run as user %q, the target runs all commands as user %q", u, outer)
+	}
+	return nil
+}
+
+// Check the users of all commands of the plan before anything is executed.
+func checkPlanUsers(t Target, p *Plan) error {
+	outer := targetRunAs(t)
+	for _, t := range p.Tasks {
+		for _, c := range t.Commands {
+			if c.command == nil {
+				continue
+			}
+			if err := checkRunAs(outer, c.command.command); err != nil {
+				return fmt.Errorf("task %q: command %d: %s", t.Name, c.Index, err)
+			}
+		}
+	}
+	return nil
+}
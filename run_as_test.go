@@ -0,0 +1,138 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dynport/urknall/target"
+)
+
+type runAsCommand struct {
+	*testCommand
+	user string
+}
+
+func (c *runAsCommand) RunAs() string {
+	return c.user
+}
+
+type runAsRebootCommand struct {
+	*runAsCommand
+}
+
+func (c *runAsRebootCommand) RebootTimeout() time.Duration {
+	return time.Minute
+}
+
+func TestRunAsChecksum(t *testing.T) {
+	plain, _ := commandChecksum(&testCommand{cmd: "echo 1"})
+	if v, _ := commandChecksum(&runAsCommand{testCommand: &testCommand{cmd: "echo 1"}}); v != plain {
+		t.Errorf("expected checksum without user to be %s, got %s", plain, v)
+	}
+	postgres, _ := commandChecksum(&runAsCommand{testCommand: &testCommand{cmd: "echo 1"}, user: "postgres"})
+	if postgres == plain {
+		t.Errorf("expected user to change the checksum")
+	}
+	if v, _ := commandChecksum(&runAsCommand{testCommand: &testCommand{cmd: "echo 1"}, user: "app"}); v == postgres {
+		t.Errorf("expected different users to have different checksums")
+	}
+}
+
+func TestCheckRunAs(t *testing.T) {
+	for _, tc := range []struct {
+		outer  string
+		user   string
+		reboot bool
+		err    string
+	}{
+		{"", "", false, ""},
+		{"", "postgres", false, ""},
+		{"", "www-data", false, ""},
+		{"", "root", true, ""},
+		{"", "app; rm -rf /", false, `invalid user name "app; rm -rf /"`},
+		{"", "-u", false, `invalid user name "-u"`},
+		{"", "postgres", true, `reboot commands can't be run as user "postgres"`},
+		{"root", "postgres", false, ""},
+		{"app", "app", false, ""},
+		{"app", "", false, ""},
+		{"app", "postgres", false, `command can't be run as user "postgres", the target runs all commands as user "app"`},
+		{"app", "root", false, `command can't be run as user "root", the target runs all commands as user "app"`},
+	} {
+		var c interface{ Shell() string } = &runAsCommand{testCommand: &testCommand{cmd: "true"}, user: tc.user}
+		if tc.reboot {
+			c = &runAsRebootCommand{c.(*runAsCommand)}
+		}
+		err := checkRunAs(tc.outer, c)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("expected no error for user %q, got %s", tc.user, err)
+		case tc.err != "" && (err == nil || err.Error() != tc.err):
+			t.Errorf("expected error %q for user %q, got %v", tc.err, tc.user, err)
+		}
+	}
+}
+
+func TestBuildRunAs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("handing over the script to another user requires root")
+	}
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake sudo records its arguments and runs the command as the current
+	// user.
+	sudo := `#!/bin/bash
+echo "$@" >> ` + dir + `/sudo.log
+while [[ $1 == -* ]]; do
+  case $1 in
+    -u) shift 2 ;;
+    *) shift ;;
+  esac
+done
+exec "$@"
+`
+	if e := os.MkdirAll(filepath.Join(dir, "bin"), 0755); e != nil {
+		t.Fatal(e)
+	}
+	if e := ioutil.WriteFile(filepath.Join(dir, "bin", "sudo"), []byte(sudo), 0755); e != nil {
+		t.Fatal(e)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", filepath.Join(dir, "bin")+":"+os.Getenv("PATH"))
+
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base",
+			&runAsCommand{testCommand: &testCommand{cmd: "echo $FOO > " + dir + "/out"}, user: "nobody"},
+			&runAsCommand{testCommand: &testCommand{cmd: "echo root"}, user: "root"},
+		)
+	})
+	b := &Build{Target: target.NewLocalTarget(), Template: tpl, Env: []string{"FOO=bar"}, State: NewLocalStateStore(filepath.Join(dir, "state"))}
+	if e := b.Run(); e != nil {
+		t.Fatal(e)
+	}
+	out, _ := ioutil.ReadFile(filepath.Join(dir, "out"))
+	if v := strings.TrimSpace(string(out)); v != "bar" {
+		t.Errorf("expected environment to be passed on, got %q", v)
+	}
+	log, _ := ioutil.ReadFile(filepath.Join(dir, "sudo.log"))
+	if v := strings.TrimSpace(string(log)); !strings.HasPrefix(v, "-i -u nobody bash /tmp/urknall.") || strings.Count(v, "\n") != 0 {
+		t.Errorf("expected a single sudo call for user nobody, got %q", v)
+	}
+	if strings.Contains(string(log), "bar") {
+		t.Errorf("expected environment not to be passed on the command line, got %q", log)
+	}
+
+	b.Template = TemplateFunc(func(p Package) {
+		p.AddCommands("base", &runAsCommand{testCommand: &testCommand{cmd: "true"}, user: "no body"})
+	})
+	if e := b.Run(); e == nil || e.Error() != `task "base": command 0: invalid user name "no body"` {
+		t.Errorf("expected invalid user to fail the build, got %v", e)
+	}
+}
@@ -0,0 +1,126 @@
+package urknall
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A value that must not show up in the output of a build or in the state kept
+// on the target, like passwords or tokens. Secret fields of templates and the
+// values of the build's SecretEnv are masked automatically. Other secrets must
+// be added to the build's Secrets. Secrets must have at least 4 characters,
+// shorter values would mask unrelated output.
+//
+// Secrets are replaced with an opaque marker, as anything derived from the
+// value (like a checksum) would allow guessing it offline. Changes are still
+// visible, as the checksums of commands are computed from the actual values.
+type Secret string
+
+// The value replacing the secret in output and state.
+func (s Secret) Masked() string {
+	return "[secret]"
+}
+
+// Minimum length of secrets.
+const minSecretLength = 4
+
+// Empty secrets (like optional template fields not set) are allowed.
+func checkSecrets(list []Secret) error {
+	for _, s := range list {
+		if s != "" && len(s) < minSecretLength {
+			return fmt.Errorf("secrets must have at least %d characters, got one with %d", minSecretLength, len(s))
+		}
+	}
+	return nil
+}
+
+type secrets []Secret
+
+func (s secrets) Len() int           { return len(s) }
+func (s secrets) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s secrets) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+
+// Empty and duplicate secrets are dropped. Longer secrets are masked first, so
+// that secrets containing others are masked completely.
+func newSecrets(list ...Secret) secrets {
+	seen := map[Secret]struct{}{}
+	s := secrets{}
+	for _, v := range list {
+		if _, ok := seen[v]; ok || v == "" {
+			continue
+		}
+		seen[v] = struct{}{}
+		s = append(s, v)
+	}
+	sort.Stable(s)
+	return s
+}
+
+func (s secrets) mask(in string) string {
+	for _, v := range s {
+		in = strings.Replace(in, string(v), v.Masked(), -1)
+	}
+	return in
+}
+
+// Mask the shell code of a command. The content of files written by the
+// command is encoded, so secrets in it are masked and the content is encoded
+// again.
+func (s secrets) maskShell(in string) string {
+	if len(s) == 0 {
+		return in
+	}
+	if _, _, ok, err := extractWriteFile(in); err == nil && ok {
+		for _, f := range strings.Fields(in) {
+			content, err := unzip(f)
+			if err != nil {
+				continue
+			}
+			if masked := s.mask(content); masked != content {
+				in = strings.Replace(in, f, gzipBase64(masked), -1)
+			}
+		}
+	}
+	return s.mask(in)
+}
+
+func gzipBase64(content string) string {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte(content))
+	gz.Close()
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// Collect the values of the template's fields of type Secret (or a slice
+// thereof).
+func templateSecrets(tpl interface{}) (list []Secret) {
+	v := reflect.ValueOf(tpl)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	secretType := reflect.TypeOf(Secret(""))
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		switch {
+		case f.Type() == secretType:
+			list = append(list, Secret(f.String()))
+		case f.Kind() == reflect.Slice && f.Type().Elem() == secretType:
+			for j := 0; j < f.Len(); j++ {
+				list = append(list, Secret(f.Index(j).String()))
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,206 @@
+package urknall
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/dynport/urknall/pubsub"
+	"github.com/dynport/urknall/target"
+)
+
+func TestSecretsMask(t *testing.T) {
+	s := newSecrets("pass", "", "password", "pass")
+	if len(s) != 2 {
+		t.Fatalf("expected %d secrets, got %d", 2, len(s))
+	}
+	tests := []struct{ In, Expected string }{
+		{"echo password", "echo " + Secret("password").Masked()},
+		{"echo pass", "echo " + Secret("pass").Masked()},
+		{"echo nothing", "echo nothing"},
+	}
+	for _, tst := range tests {
+		if v := s.mask(tst.In); v != tst.Expected {
+			t.Errorf("expected %q to be masked as %q, got %q", tst.In, tst.Expected, v)
+		}
+	}
+	if v := Secret("password").Masked(); v != "[secret]" {
+		t.Errorf("expected masked secret to be an opaque marker, got %q", v)
+	}
+}
+
+func TestSecretsMaskWriteFile(t *testing.T) {
+	in := "mkdir -p /etc && echo " + gzipBase64("password=hunter2\n") + " | base64 -d | gunzip > /tmp/conf && mv /tmp/conf /etc/app.conf"
+	out := newSecrets("hunter2").maskShell(in)
+	path, content, ok, err := extractWriteFile(out)
+	if err != nil || !ok {
+		t.Fatalf("expected masked command to write a file, got %v", err)
+	}
+	if ex := "password=" + Secret("hunter2").Masked() + "\n"; content != ex {
+		t.Errorf("expected content %q, got %q", ex, content)
+	}
+	if path != "/etc/app.conf" {
+		t.Errorf("expected path %q, got %q", "/etc/app.conf", path)
+	}
+}
+
+type secretTemplate struct {
+	Password Secret
+	Keys     []Secret
+	User     string
+}
+
+func (tpl *secretTemplate) Render(p Package) {
+	p.AddCommands("base", &testCommand{cmd: "echo {{ .User }}:{{ .Password }}"}, &testCommand{cmd: "echo $TOKEN >&2"})
+}
+
+func TestTemplateSecrets(t *testing.T) {
+	v := templateSecrets(&secretTemplate{Password: "hunter2", Keys: []Secret{"a", "b"}, User: "root"})
+	if s := strings.Join([]string{string(v[0]), string(v[1]), string(v[2])}, ","); len(v) != 3 || s != "hunter2,a,b" {
+		t.Errorf("expected secrets %q, got %v", "hunter2,a,b", v)
+	}
+	if v := templateSecrets(TemplateFunc(func(Package) {})); len(v) != 0 {
+		t.Errorf("expected no secrets, got %v", v)
+	}
+}
+
+func TestBuildSecrets(t *testing.T) {
+	events := pubsub.NewEvents()
+	out := []string{}
+	events.Subscribe(pubsub.SinkFunc(func(m *pubsub.Message) {
+		out = append(out, m.Message, m.Line)
+	}))
+	state := NewMemoryStateStore()
+	tgt := &recordingTarget{Target: target.NewLocalTarget()}
+	b := &Build{
+		Target:    tgt,
+		Template:  &secretTemplate{Password: "hunter2", User: "root"},
+		State:     state,
+		Events:    events,
+		SecretEnv: map[string]Secret{"TOKEN": "tok123"},
+	}
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range tgt.commands {
+		if strings.Contains(c, "tok123") {
+			t.Errorf("expected secret environment not to be part of the command, got %q", c)
+		}
+	}
+
+	all := strings.Join(out, "\n")
+	for _, s := range []string{"hunter2", "tok123"} {
+		if strings.Contains(all, s) {
+			t.Errorf("expected secret %q to be masked in messages, got %q", s, all)
+		}
+	}
+	if ex := "root:" + Secret("hunter2").Masked(); !strings.Contains(all, ex) {
+		t.Errorf("expected messages to contain %q, got %q", ex, all)
+	}
+
+	logs, err := ReadLogs(b.Target, state, "base", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{}
+	for _, l := range logs {
+		lines = append(lines, l.Line)
+	}
+	ex := "root:" + Secret("hunter2").Masked() + "," + Secret("tok123").Masked()
+	if v := strings.Join(lines, ","); v != ex {
+		t.Errorf("expected logs %q, got %q", ex, v)
+	}
+
+	ts, err := state.ReadState(b.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The checksum is computed from the actual value.
+	cs, err := commandChecksum(&testCommand{cmd: "echo root:hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ts["base"].Checksums[0]; v != cs {
+		t.Errorf("expected checksum %q, got %q", cs, v)
+	}
+	if v, ex := ts["base"].Content[cs], "echo root:"+Secret("hunter2").Masked(); v != ex {
+		t.Errorf("expected content %q, got %q", ex, v)
+	}
+
+	// Changing the secret changes the command.
+	b.Template = &secretTemplate{Password: "hunter3", User: "root"}
+	p, err := b.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := p.Tasks[0].Commands[0].Status; v != PlanChanged {
+		t.Errorf("expected status %q, got %q", PlanChanged, v)
+	}
+}
+
+type recordingTarget struct {
+	Target
+	commands []string
+}
+
+func (t *recordingTarget) Command(cmd string) (target.ExecCommand, error) {
+	t.commands = append(t.commands, cmd)
+	return t.Target.Command(cmd)
+}
+
+type stdinCommand struct {
+	*testCommand
+	input string
+}
+
+func (c *stdinCommand) Input() io.ReadCloser {
+	return ioutil.NopCloser(strings.NewReader(c.input))
+}
+
+func TestBuildEnvWithStdin(t *testing.T) {
+	out := []string{}
+	events := pubsub.NewEvents()
+	events.Subscribe(pubsub.SinkFunc(func(m *pubsub.Message) {
+		if m.Key == pubsub.MessageCommandOutput+".line" {
+			out = append(out, m.Line)
+		}
+	}))
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base", &stdinCommand{testCommand: &testCommand{cmd: `echo "$FOO $TOKEN $(cat)"`}, input: "input"})
+	})
+	b := &Build{
+		Target:    target.NewLocalTarget(),
+		Template:  tpl,
+		State:     NewMemoryStateStore(),
+		Events:    events,
+		Env:       []string{"FOO=it's"},
+		SecretEnv: map[string]Secret{"TOKEN": "tok123"},
+	}
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := strings.Join(out, "\n"), "it's "+Secret("tok123").Masked()+" input"; v != ex {
+		t.Errorf("expected output %q, got %q", ex, v)
+	}
+}
+
+func TestShortSecrets(t *testing.T) {
+	b := &Build{Target: target.NewLocalTarget(), Template: &secretTemplate{User: "root"}, State: NewMemoryStateStore()}
+	for _, s := range []Secret{"", "abcd"} {
+		b.Secrets = []Secret{s}
+		if _, err := b.Plan(); err != nil {
+			t.Errorf("expected secret %q to be accepted, got %s", s, err)
+		}
+	}
+	b.Secrets = nil
+	b.SecretEnv = map[string]Secret{"PIN": "abc"}
+	if _, err := b.Plan(); err == nil || err.Error() != "secrets must have at least 4 characters, got one with 3" {
+		t.Errorf("expected short secret to be rejected, got %v", err)
+	}
+	b.SecretEnv = nil
+	b.Template = &secretTemplate{Password: "ab", User: "root"}
+	if _, err := b.Plan(); err == nil {
+		t.Errorf("expected short secret of the template to be rejected")
+	}
+}
@@ -0,0 +1,255 @@
+package urknall
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A state store keeps track of the commands executed on targets. The state is
+// used to decide which commands of a build must be executed and which are
+// cached.
+type StateStore interface {
+	ReadState(t Target) (map[string]*TaskState, error)             // Read the state of all tasks of the target.
+	Record(t Target, r *CommandRecord) error                       // Record the execution of a command.
+	ListRuns(t Target, task string) ([]*TaskRun, error)            // List the runs of a task (oldest first).
+	Invalidate(t Target, task string, index int) error             // Force execution of the task's commands starting with the given index.
+	Remove(t Target, task string) error                            // Remove all state of the task.
+	RunLogs(t Target, task, run string) (map[string][]byte, error) // Read the logs of a task's run by command checksum.
+	RecordRollback(t Target, r *RollbackRecord) error              // Record the rollback of a failed task.
+}
+
+// State stores that must prepare the target before commands are run (e.g. to
+// migrate the layout of earlier versions) implement the StatePreparer
+// interface. Only builds running commands prepare the target, reading the
+// state must not change it. Files written should use the given run ID of the
+// build, so that they don't outlast the build's own records.
+type StatePreparer interface {
+	Prepare(t Target, run string) error
+}
+
+// The state of a task: the commands executed successfully in the task's last
+// run.
+type TaskState struct {
+	Name      string            // Name of the task.
+	LastRun   string            // Identifier of the task's last run.
+	Checksums []string          // Checksums of the executed commands (in order).
+	Content   map[string]string // Shell code of the executed commands by checksum.
+}
+
+// The record of a single executed command.
+type CommandRecord struct {
+	Task      string   // Name of the task.
+	Run       string   // Identifier of the run (derived from the build's start time).
+	Checksum  string   // Checksum of the command.
+	Content   string   // Shell code of the command.
+	Checksums []string // Checksums of the task's commands up to and including this one.
+	Failed    bool     // Whether the command failed.
+	Log       []byte   // Output of the command. Lines of timestamp, stream and text separated by tabs.
+}
+
+// The record of the rollback of a task after one of its commands failed.
+type RollbackRecord struct {
+	Task      string          // Name of the task.
+	Run       string          // Identifier of the run.
+	Checksums []string        // Checksums of the task's commands still considered executed.
+	Steps     []*RollbackStep // The undo commands and failure hooks run (in order).
+}
+
+// A single command run during the rollback of a task.
+type RollbackStep struct {
+	Command string // Log message of the command.
+	Hook    bool   // Whether the command is a failure hook of the task (an undo command otherwise).
+	Failed  bool   // Whether the command failed.
+}
+
+// A task run is a single execution of a task's commands.
+type TaskRun struct {
+	ID       string          // Identifier of the run.
+	Done     []string        // Checksums of the commands executed successfully (in order).
+	Failed   []string        // Checksums of the commands that failed.
+	Rollback []*RollbackStep // Commands run to roll back the task if it failed.
+}
+
+// Format of run identifiers.
+const runIDFormat = "20060102_150405"
+
+func newRunID(t time.Time) string {
+	return t.UTC().Format(runIDFormat)
+}
+
+// The files written for a command record, relative to the cache directory.
+// Both the on-host store and the local store use the same layout:
+//
+//	<task>/build.<run>/<checksum>.{done,failed,log}
+//	<task>/build.<run>/<run>.run
+//	<task>/<checksum>.{done,failed,log} (copies of the latest build)
+//	<task>/<run>.run
+//
+// A run file lists the done files of all commands executed successfully (in
+// order) using the given directory as prefix. The latest run file of a task
+// determines the task's state.
+func recordFiles(dir string, r *CommandRecord) map[string][]byte {
+	suffix := ".done"
+	if r.Failed {
+		suffix = ".failed"
+	}
+	build := r.Task + "/build." + r.Run + "/"
+	content := []byte(r.Content + "\n")
+	files := map[string][]byte{
+		build + r.Checksum + suffix:        content,
+		build + r.Checksum + ".log":        r.Log,
+		r.Task + "/" + r.Checksum + suffix: content,
+		r.Task + "/" + r.Checksum + ".log": r.Log,
+	}
+	if !r.Failed {
+		lines := []string{}
+		for _, cs := range r.Checksums {
+			lines = append(lines, dir+"/"+r.Task+"/"+cs+".done")
+		}
+		run := []byte(strings.Join(lines, "\n") + "\n")
+		files[build+r.Run+".run"] = run
+		files[r.Task+"/"+r.Run+".run"] = run
+	}
+	return files
+}
+
+// The run files written after a rollback: the done files of the commands still
+// considered executed, followed by the rollback's steps as comments.
+func rollbackFiles(dir string, r *RollbackRecord) map[string][]byte {
+	lines := []string{}
+	for _, cs := range r.Checksums {
+		lines = append(lines, dir+"/"+r.Task+"/"+cs+".done")
+	}
+	for _, s := range r.Steps {
+		lines = append(lines, s.String())
+	}
+	run := []byte(strings.Join(lines, "\n") + "\n")
+	return map[string][]byte{
+		r.Task + "/build." + r.Run + "/" + r.Run + ".run": run,
+		r.Task + "/" + r.Run + ".run":                     run,
+	}
+}
+
+const rollbackPrefix = "# rollback "
+
+func (s *RollbackStep) String() string {
+	kind, status := "undo", "ok"
+	if s.Hook {
+		kind = "hook"
+	}
+	if s.Failed {
+		status = "failed"
+	}
+	return rollbackPrefix + kind + " " + status + " " + strings.Join(strings.Fields(s.Command), " ")
+}
+
+func parseRollbackStep(line string) (*RollbackStep, bool) {
+	if !strings.HasPrefix(line, rollbackPrefix) {
+		return nil, false
+	}
+	fields := strings.SplitN(strings.TrimPrefix(line, rollbackPrefix), " ", 3)
+	if len(fields) < 2 {
+		return nil, false
+	}
+	s := &RollbackStep{Hook: fields[0] == "hook", Failed: fields[1] == "failed"}
+	if len(fields) == 3 {
+		s.Command = fields[2]
+	}
+	return s, true
+}
+
+// Lines starting with "#" are comments (like the steps of a rollback).
+// Run files of earlier versions also reference failed commands, only the
+// commands up to the first failed one are considered executed.
+func parseRunFile(b []byte) (checksums []string) {
+	for _, f := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		switch f = strings.TrimSpace(f); {
+		case f == "" || strings.HasPrefix(f, "#"):
+		case !strings.HasSuffix(f, ".done"):
+			return checksums
+		default:
+			checksums = append(checksums, doneFileToChecksum(f))
+		}
+	}
+	return checksums
+}
+
+func parseRollback(b []byte) (steps []*RollbackStep) {
+	for _, l := range strings.Split(string(b), "\n") {
+		if s, ok := parseRollbackStep(strings.TrimSpace(l)); ok {
+			steps = append(steps, s)
+		}
+	}
+	return steps
+}
+
+// Scripts written by earlier versions contain a header that is not part of
+// the command.
+func parseDoneFile(b []byte) string {
+	return strings.TrimSuffix(strings.TrimPrefix(string(b), "#!/bin/sh\nset -e\nset -x\n\n\n"), "\n")
+}
+
+func doneFileToChecksum(in string) string {
+	return strings.TrimSuffix(filepath.Base(in), ".done")
+}
+
+func runFileToID(in string) string {
+	return strings.TrimSuffix(filepath.Base(in), ".run")
+}
+
+// The given store is used if set. Otherwise targets implementing the
+// StateStore interface themselves are used and the on-host store for all
+// other targets.
+func stateStoreFor(t Target, s StateStore) StateStore {
+	if s != nil {
+		return s
+	}
+	if s, ok := t.(StateStore); ok {
+		return s
+	}
+	return NewTargetStateStore()
+}
+
+// Task names are used as directory names by the stores, so they must not
+// reference other directories.
+func checkTaskName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, taskNameMetaChars) {
+		return fmt.Errorf("invalid task name %q", name)
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("invalid task name %q", name)
+		}
+	}
+	return nil
+}
+
+// Task names are used as directory names and in shell commands on the target,
+// so path separators and shell metacharacters are not allowed.
+const taskNameMetaChars = "/\\`$;&|<>()'\"*?[]{}!#~"
+
+// Parse a reference to a task's command in the form `<task>[.<index>]`. As task
+// names may contain dots themselves, the reference is taken as task name if it
+// is one of the given tasks. The index is 0 if not given. Task names are not
+// checked if no tasks are given.
+func ParseTaskRef(ref string, tasks map[string]*TaskState) (task string, index int, err error) {
+	task = ref
+	if _, ok := tasks[ref]; !ok {
+		if i := strings.LastIndex(ref, "."); i > 0 {
+			if idx, err := strconv.Atoi(ref[i+1:]); err == nil {
+				task, index = ref[:i], idx
+			}
+		}
+	}
+	if index < 0 {
+		return "", 0, fmt.Errorf("invalid command index %d", index)
+	}
+	if _, ok := tasks[task]; tasks != nil && !ok {
+		return "", 0, fmt.Errorf("task %q not found", task)
+	}
+	return task, index, checkTaskName(task)
+}
@@ -0,0 +1,188 @@
+package urknall
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Create a state store keeping the state in the given local directory, using a
+// directory per target. This allows to provision targets with read-only root
+// file systems incrementally and to keep the state if a host is reimaged.
+func NewLocalStateStore(dir string) StateStore {
+	return &localStateStore{dir: dir}
+}
+
+type localStateStore struct {
+	dir string
+}
+
+func (s *localStateStore) hostDir(t Target) string {
+	return filepath.Join(s.dir, strings.Replace(t.String(), string(filepath.Separator), "_", -1))
+}
+
+func (s *localStateStore) ReadState(t Target) (map[string]*TaskState, error) {
+	m := map[string]*TaskState{}
+	dir := s.hostDir(t)
+	dirs, err := ioutil.ReadDir(dir)
+	switch {
+	case os.IsNotExist(err):
+		return m, nil
+	case err != nil:
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		runs, err := filepath.Glob(filepath.Join(dir, d.Name(), "*.run"))
+		if err != nil {
+			return nil, err
+		}
+		if len(runs) == 0 {
+			continue
+		}
+		sort.Strings(runs)
+		last := runs[len(runs)-1]
+		b, err := ioutil.ReadFile(last)
+		if err != nil {
+			return nil, err
+		}
+		ts := &TaskState{Name: d.Name(), LastRun: runFileToID(last), Checksums: parseRunFile(b), Content: map[string]string{}}
+		for _, cs := range ts.Checksums {
+			b, err := ioutil.ReadFile(filepath.Join(dir, d.Name(), cs+".done"))
+			if err != nil {
+				return nil, err
+			}
+			ts.Content[cs] = parseDoneFile(b)
+		}
+		m[ts.Name] = ts
+	}
+	return m, nil
+}
+
+func (s *localStateStore) Record(t Target, r *CommandRecord) error {
+	if err := checkTaskName(r.Task); err != nil {
+		return err
+	}
+	dir := s.hostDir(t)
+	for name, content := range recordFiles(dir, r) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *localStateStore) RecordRollback(t Target, r *RollbackRecord) error {
+	if err := checkTaskName(r.Task); err != nil {
+		return err
+	}
+	dir := s.hostDir(t)
+	for name, content := range rollbackFiles(dir, r) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *localStateStore) ListRuns(t Target, task string) ([]*TaskRun, error) {
+	if err := checkTaskName(task); err != nil {
+		return nil, err
+	}
+	dirs, err := filepath.Glob(filepath.Join(s.hostDir(t), task, "build.*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+	runs := []*TaskRun{}
+	for _, dir := range dirs {
+		run := &TaskRun{ID: strings.TrimPrefix(filepath.Base(dir), "build.")}
+		files, err := filepath.Glob(filepath.Join(dir, "*.run"))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			b, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			run.Done = parseRunFile(b)
+			run.Rollback = parseRollback(b)
+		}
+		failed, err := filepath.Glob(filepath.Join(dir, "*.failed"))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range failed {
+			run.Failed = append(run.Failed, strings.TrimSuffix(filepath.Base(f), ".failed"))
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+func (s *localStateStore) Invalidate(t Target, task string, index int) error {
+	if err := checkTaskName(task); err != nil {
+		return err
+	}
+	if index < 0 {
+		return fmt.Errorf("invalid command index %d", index)
+	}
+	runs, err := filepath.Glob(filepath.Join(s.hostDir(t), task, "*.run"))
+	if err != nil || len(runs) == 0 {
+		return err
+	}
+	sort.Strings(runs)
+	last := runs[len(runs)-1]
+	b, err := ioutil.ReadFile(last)
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	if index < len(lines) {
+		lines = lines[:index]
+	}
+	return ioutil.WriteFile(last, []byte(strings.Join(lines, "")), 0644)
+}
+
+func (s *localStateStore) Remove(t Target, task string) error {
+	if err := checkTaskName(task); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(s.hostDir(t), task))
+}
+
+func (s *localStateStore) RunLogs(t Target, task, run string) (map[string][]byte, error) {
+	if err := checkTaskName(task); err != nil {
+		return nil, err
+	}
+	if err := checkTaskName(run); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(s.hostDir(t), task, "build."+run, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	logs := map[string][]byte{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		logs[strings.TrimSuffix(filepath.Base(f), ".log")] = b
+	}
+	return logs, nil
+}
@@ -0,0 +1,187 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewLocalStateStore(dir)
+	tg := &unreachableTarget{name: "root@host"}
+
+	records := []*CommandRecord{
+		{Task: "base", Run: "20150101_120000", Checksum: "a", Content: "echo a", Checksums: []string{"a"}},
+		{Task: "base", Run: "20150101_120000", Checksum: "b", Content: "echo b", Checksums: []string{"a", "b"}},
+		{Task: "base", Run: "20150102_120000", Checksum: "c", Content: "echo c", Checksums: []string{"a", "c"}, Failed: true},
+	}
+	for _, r := range records {
+		if err := s.Record(tg, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state, err := s.ReadState(tg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, ok := state["base"]
+	if !ok {
+		t.Fatalf("expected state for task base, got %v", state)
+	}
+	if ts.LastRun != "20150101_120000" {
+		t.Errorf("expected last run to be %q, got %q", "20150101_120000", ts.LastRun)
+	}
+	if v := strings.Join(ts.Checksums, ","); v != "a,b" {
+		t.Errorf("expected checksums to be %q, got %q", "a,b", v)
+	}
+	if ts.Content["b"] != "echo b" {
+		t.Errorf("expected content of b to be %q, got %q", "echo b", ts.Content["b"])
+	}
+
+	runs, err := s.ListRuns(tg, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("expected %d runs, got %d", 2, len(runs))
+	}
+	if v := strings.Join(runs[0].Done, ","); v != "a,b" {
+		t.Errorf("expected done commands of first run to be %q, got %q", "a,b", v)
+	}
+	if v := strings.Join(runs[1].Failed, ","); v != "c" {
+		t.Errorf("expected failed commands of second run to be %q, got %q", "c", v)
+	}
+}
+
+func TestParseDoneFile(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"echo a\n", "echo a"},
+		{"#!/bin/sh\nset -e\nset -x\n\n\necho a\n", "echo a"},
+	}
+	for _, tc := range tests {
+		if v := parseDoneFile([]byte(tc.in)); v != tc.out {
+			t.Errorf("expected %q, got %q", tc.out, v)
+		}
+	}
+}
+
+func TestLocalStateStoreInvalidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewLocalStateStore(dir)
+	tg := &unreachableTarget{name: "host"}
+	for _, r := range []*CommandRecord{
+		{Task: "base", Run: "20150101_120000", Checksum: "a", Content: "echo a", Checksums: []string{"a"}},
+		{Task: "base", Run: "20150101_120000", Checksum: "b", Content: "echo b", Checksums: []string{"a", "b"}},
+		{Task: "other", Run: "20150101_120000", Checksum: "c", Content: "echo c", Checksums: []string{"c"}},
+	} {
+		if err := s.Record(tg, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Invalidate(tg, "base", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(tg, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(tg, "../host"); err == nil {
+		t.Errorf("expected an error removing an invalid task")
+	}
+
+	state, err := s.ReadState(tg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state) != 1 {
+		t.Errorf("expected %d task, got %d", 1, len(state))
+	}
+	if v := strings.Join(state["base"].Checksums, ","); v != "a" {
+		t.Errorf("expected checksums to be %q, got %q", "a", v)
+	}
+}
+
+func TestBuildPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewLocalStateStore(dir)
+	tg := &unreachableTarget{name: "host"}
+	for _, task := range []string{"base", "removed"} {
+		cs, err := commandChecksum(Shell("echo " + task))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &CommandRecord{Task: task, Run: "20150101_120000", Checksum: cs, Content: "echo " + task, Checksums: []string{cs}}
+		if err := s.Record(tg, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := &Build{Target: tg, State: s, Template: TemplateFunc(func(p Package) {
+		p.AddCommands("base", Shell("echo base"))
+	})}
+	removed, err := b.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := strings.Join(removed, ","); v != "removed" {
+		t.Errorf("expected removed tasks to be %q, got %q", "removed", v)
+	}
+	state, err := s.ReadState(tg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state["removed"]; ok {
+		t.Errorf("expected state of task %q to be removed", "removed")
+	}
+	if _, ok := state["base"]; !ok {
+		t.Errorf("expected state of task %q to be kept", "base")
+	}
+
+	// The shortcut uses the template given.
+	removed, err = Prune(tg, TemplateFunc(func(p Package) {}), func(b *Build) { b.State = s })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := strings.Join(removed, ","); v != "base" {
+		t.Errorf("expected removed tasks to be %q, got %q", "base", v)
+	}
+}
+
+func TestLocalStateStoreTaskNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewLocalStateStore(filepath.Join(dir, "state"))
+	tg := &unreachableTarget{name: "host"}
+	for _, task := range []string{"..", "../../escaped"} {
+		r := &CommandRecord{Task: task, Run: "20150101_120000", Checksum: "a", Content: "echo a", Checksums: []string{"a"}}
+		if err := s.Record(tg, r); err == nil {
+			t.Errorf("expected task name %q to be rejected", task)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("expected nothing to be written, got %v", files)
+	}
+}
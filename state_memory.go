@@ -0,0 +1,172 @@
+package urknall
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Create a state store keeping the state in memory, using a separate state per
+// target. This is mostly useful for testing.
+func NewMemoryStateStore() StateStore {
+	return &memoryStateStore{hosts: map[string]map[string]*memoryTask{}}
+}
+
+type memoryStateStore struct {
+	mutex sync.Mutex
+	hosts map[string]map[string]*memoryTask
+}
+
+type memoryTask struct {
+	lastRun   string
+	checksums []string
+	content   map[string]string
+	runs      map[string]*memoryRun
+}
+
+type memoryRun struct {
+	run  *TaskRun
+	logs map[string][]byte
+}
+
+func (s *memoryStateStore) tasks(t Target) map[string]*memoryTask {
+	tasks, ok := s.hosts[t.String()]
+	if !ok {
+		tasks = map[string]*memoryTask{}
+		s.hosts[t.String()] = tasks
+	}
+	return tasks
+}
+
+// The task and run are created if they don't exist yet.
+func (s *memoryStateStore) run(t Target, name, id string) (*memoryTask, *memoryRun) {
+	tasks := s.tasks(t)
+	task, ok := tasks[name]
+	if !ok {
+		task = &memoryTask{content: map[string]string{}, runs: map[string]*memoryRun{}}
+		tasks[name] = task
+	}
+	run, ok := task.runs[id]
+	if !ok {
+		run = &memoryRun{run: &TaskRun{ID: id}, logs: map[string][]byte{}}
+		task.runs[id] = run
+	}
+	return task, run
+}
+
+func (s *memoryStateStore) ReadState(t Target) (map[string]*TaskState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := map[string]*TaskState{}
+	for name, task := range s.tasks(t) {
+		if task.lastRun == "" {
+			continue
+		}
+		ts := &TaskState{Name: name, LastRun: task.lastRun, Checksums: append([]string{}, task.checksums...), Content: map[string]string{}}
+		for _, cs := range ts.Checksums {
+			ts.Content[cs] = task.content[cs]
+		}
+		m[name] = ts
+	}
+	return m, nil
+}
+
+func (s *memoryStateStore) Record(t Target, r *CommandRecord) error {
+	if err := checkTaskName(r.Task); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	task, run := s.run(t, r.Task, r.Run)
+	run.logs[r.Checksum] = append([]byte{}, r.Log...)
+	if r.Failed {
+		run.run.Failed = append(run.run.Failed, r.Checksum)
+		return nil
+	}
+	task.content[r.Checksum] = r.Content
+	task.checksums = append([]string{}, r.Checksums...)
+	task.lastRun = r.Run
+	run.run.Done = append([]string{}, r.Checksums...)
+	return nil
+}
+
+func (s *memoryStateStore) RecordRollback(t Target, r *RollbackRecord) error {
+	if err := checkTaskName(r.Task); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	task, run := s.run(t, r.Task, r.Run)
+	task.checksums = append([]string{}, r.Checksums...)
+	task.lastRun = r.Run
+	run.run.Done = append([]string{}, r.Checksums...)
+	for _, st := range r.Steps {
+		step := *st
+		run.run.Rollback = append(run.run.Rollback, &step)
+	}
+	return nil
+}
+
+func (s *memoryStateStore) ListRuns(t Target, task string) ([]*TaskRun, error) {
+	if err := checkTaskName(task); err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	runs := []*TaskRun{}
+	if mt, ok := s.tasks(t)[task]; ok {
+		for _, r := range mt.runs {
+			runs = append(runs, &TaskRun{ID: r.run.ID, Done: append([]string{}, r.run.Done...), Failed: append([]string{}, r.run.Failed...), Rollback: append([]*RollbackStep{}, r.run.Rollback...)})
+		}
+	}
+	sort.Sort(taskRuns(runs))
+	return runs, nil
+}
+
+func (s *memoryStateStore) Invalidate(t Target, task string, index int) error {
+	if err := checkTaskName(task); err != nil {
+		return err
+	}
+	if index < 0 {
+		return fmt.Errorf("invalid command index %d", index)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if mt, ok := s.tasks(t)[task]; ok && index < len(mt.checksums) {
+		mt.checksums = mt.checksums[:index]
+	}
+	return nil
+}
+
+func (s *memoryStateStore) Remove(t Target, task string) error {
+	if err := checkTaskName(task); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.tasks(t), task)
+	return nil
+}
+
+func (s *memoryStateStore) RunLogs(t Target, task, run string) (map[string][]byte, error) {
+	if err := checkTaskName(task); err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	logs := map[string][]byte{}
+	if mt, ok := s.tasks(t)[task]; ok {
+		if r, ok := mt.runs[run]; ok {
+			for cs, l := range r.logs {
+				logs[cs] = append([]byte{}, l...)
+			}
+		}
+	}
+	return logs, nil
+}
+
+type taskRuns []*TaskRun
+
+func (r taskRuns) Len() int           { return len(r) }
+func (r taskRuns) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r taskRuns) Less(i, j int) bool { return r[i].ID < r[j].ID }
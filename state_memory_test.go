@@ -0,0 +1,64 @@
+package urknall
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemoryStateStore(t *testing.T) {
+	s := NewMemoryStateStore()
+	tg := &unreachableTarget{name: "host"}
+	for _, r := range []*CommandRecord{
+		{Task: "base", Run: "20150101_120000", Checksum: "a", Content: "echo a", Checksums: []string{"a"}, Log: []byte("a\n")},
+		{Task: "base", Run: "20150101_120000", Checksum: "b", Content: "echo b", Checksums: []string{"a", "b"}},
+		{Task: "base", Run: "20150102_120000", Checksum: "c", Content: "echo c", Checksums: []string{"a", "c"}, Failed: true},
+		{Task: "other", Run: "20150102_120000", Checksum: "d", Content: "echo d", Checksums: []string{"d"}},
+	} {
+		if err := s.Record(tg, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state, err := s.ReadState(tg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := strings.Join(state["base"].Checksums, ","); v != "a,b" {
+		t.Errorf("expected checksums to be %q, got %q", "a,b", v)
+	}
+	if v := state["base"].Content["b"]; v != "echo b" {
+		t.Errorf("expected content of b to be %q, got %q", "echo b", v)
+	}
+	if state, _ := s.ReadState(&unreachableTarget{name: "other"}); len(state) != 0 {
+		t.Errorf("expected no state for other target, got %d tasks", len(state))
+	}
+
+	runs, err := s.ListRuns(tg, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || runs[0].ID != "20150101_120000" || strings.Join(runs[1].Failed, ",") != "c" {
+		t.Errorf("unexpected runs %+v", runs)
+	}
+	logs, err := s.RunLogs(tg, "base", "20150101_120000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := string(logs["a"]); v != "a\n" {
+		t.Errorf("expected log of a to be %q, got %q", "a\n", v)
+	}
+
+	if err := s.Invalidate(tg, "base", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(tg, "other"); err != nil {
+		t.Fatal(err)
+	}
+	state, err = s.ReadState(tg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state) != 1 || strings.Join(state["base"].Checksums, ",") != "a" {
+		t.Errorf("expected only the first command of base to be kept, got %v", state)
+	}
+}
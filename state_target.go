@@ -0,0 +1,399 @@
+package urknall
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Create a state store keeping the state on the target itself, in the
+// /var/lib/urknall directory. This is the default store of a build.
+func NewTargetStateStore() StateStore {
+	return &targetStateStore{}
+}
+
+type targetStateStore struct{}
+
+// Hosts provisioned with earlier versions either have no run files at all or
+// run files that also reference failed commands. The migration creates run
+// files from the done files found or truncates run files at the first failed
+// command (in place). Migrated hosts are marked with the `.v3` file. Reading
+// the state of hosts not migrated yet gives the same result (see
+// readItemsFromTar).
+//
+// Run files are named by the run ID, the latest run of a task is the one with
+// the greatest name. The modification times are not used, as they depend on
+// the clocks of both the building host and the target.
+const migrateCmd = `
+bash <<"EOF"
+set -e
+
+sudo_prefix=""
+if [[ $(id -u) != 0 ]]; then
+  sudo_prefix="sudo"
+fi
+
+if [[ ! -d /var/lib/urknall ]] || [[ -f /var/lib/urknall/.v3 ]]; then
+  exit
+fi
+
+for dir in $(find /var/lib/urknall -maxdepth 1 -mindepth 1 -type d); do
+  last_run=$(ls $dir/*.run 2> /dev/null | sort | tail -n1)
+  if [[ -z $last_run ]]; then
+    if ls $dir/*.done > /dev/null 2>&1; then
+      ls -tr $dir/*.done | $sudo_prefix tee $dir/{{ .Run }}.run > /dev/null
+    fi
+  elif grep -qv '\.done$' $last_run; then
+    awk '!/\.done$/ { exit } { print }' $last_run | $sudo_prefix tee $last_run.tmp > /dev/null
+    $sudo_prefix mv $last_run.tmp $last_run
+  fi
+done
+
+$sudo_prefix touch /var/lib/urknall/.v3
+EOF
+`
+
+// The state is read without changing anything on the host. For hosts not
+// migrated yet, the done files of tasks without run file are sent as well.
+const stateCmd = `
+bash <<"EOF"
+set -e
+
+if [[ ! -d /var/lib/urknall ]]; then
+  exit
+fi
+files=$(find /var/lib/urknall -maxdepth 1 -mindepth 1 -type d)
+
+if [[ -z $files ]]; then
+  exit
+fi
+
+runs=$(
+	for dir in $files; do
+		last_run=$(ls $dir/*.run 2> /dev/null | sort | tail -n1)
+		if [[ -n $last_run ]]; then
+			echo $last_run
+			grep -v "^#" $last_run | grep '\.done$' || true
+		elif [[ ! -f /var/lib/urknall/.v3 ]]; then
+			ls $dir/*.done 2> /dev/null || true
+		fi
+	done
+)
+
+if [[ -z $runs ]]; then
+  exit
+fi
+
+tar cvz $runs
+EOF
+`
+
+// The record's files are sent as tar archive on standard input.
+const recordCmd = `sudo_prefix=""; [ "$(id -u)" = 0 ] || sudo_prefix="sudo"; $sudo_prefix mkdir -p ` + ukCACHEDIR + ` && $sudo_prefix tar xz -C ` + ukCACHEDIR
+
+const listRunsTpl = `
+bash <<"EOF"
+for dir in $(ls -d /var/lib/urknall/{{ .Name }}/build.* 2> /dev/null); do
+  echo $dir
+  cat $dir/*.run 2> /dev/null || true
+  ls $dir/*.failed 2> /dev/null || true
+done
+EOF
+`
+
+const invalidateTpl = `
+bash <<"EOF"
+set -e
+
+sudo_prefix=""
+if [[ $(id -u) != 0 ]]; then
+  sudo_prefix="sudo"
+fi
+
+last_run=$(ls /var/lib/urknall/{{ .Name }}/*.run 2> /dev/null | sort | tail -n1)
+if [[ -z $last_run ]]; then
+  exit
+fi
+head -n {{ .Index }} $last_run | $sudo_prefix tee $last_run.tmp > /dev/null
+$sudo_prefix mv $last_run.tmp $last_run
+EOF
+`
+
+const removeTpl = `
+bash <<"EOF"
+set -e
+
+sudo_prefix=""
+if [[ $(id -u) != 0 ]]; then
+  sudo_prefix="sudo"
+fi
+
+$sudo_prefix rm -rf /var/lib/urknall/{{ .Name }}
+EOF
+`
+
+const runLogsTpl = `
+bash <<"EOF"
+cd /var/lib/urknall/{{ .Name }}/build.{{ .Run }} 2> /dev/null || exit 0
+ls *.log > /dev/null 2>&1 || exit 0
+tar cz *.log
+EOF
+`
+
+// Hosts using the layout of earlier versions are migrated before commands are
+// run.
+func (s *targetStateStore) Prepare(target Target, run string) error {
+	cmd, err := render(migrateCmd, struct{ Run string }{Run: run})
+	if err != nil {
+		return err
+	}
+	if _, err := capture(target, cmd); err != nil {
+		return fmt.Errorf("migrating cache directory: %s", err)
+	}
+	return nil
+}
+
+// Read the state of all tasks from the target. Nothing is changed on the
+// target.
+func (s *targetStateStore) ReadState(target Target) (map[string]*TaskState, error) {
+	b, err := capture(target, stateCmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return map[string]*TaskState{}, nil
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	t := tar.NewReader(gz)
+
+	return readItemsFromTar(t)
+}
+
+func (s *targetStateStore) Record(target Target, r *CommandRecord) error {
+	if err := checkTaskName(r.Task); err != nil {
+		return err
+	}
+	if err := writeFiles(target, recordFiles(ukCACHEDIR, r)); err != nil {
+		return fmt.Errorf("recording command %s of task %q: %s", r.Checksum, r.Task, err)
+	}
+	return nil
+}
+
+func (s *targetStateStore) RecordRollback(target Target, r *RollbackRecord) error {
+	if err := checkTaskName(r.Task); err != nil {
+		return err
+	}
+	if err := writeFiles(target, rollbackFiles(ukCACHEDIR, r)); err != nil {
+		return fmt.Errorf("recording rollback of task %q: %s", r.Task, err)
+	}
+	return nil
+}
+
+// The files (relative to the cache directory) are sent as tar archive on
+// standard input.
+func writeFiles(target Target, files map[string][]byte) error {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, name := range names {
+		h := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), ModTime: now, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	c, err := target.Command(recordCmd)
+	if err != nil {
+		return err
+	}
+	c.SetStdin(buf)
+	stdErr := &bytes.Buffer{}
+	c.SetStderr(stdErr)
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("%s stderr=%q", err, stdErr.String())
+	}
+	return nil
+}
+
+func (s *targetStateStore) ListRuns(target Target, task string) ([]*TaskRun, error) {
+	if err := checkTaskName(task); err != nil {
+		return nil, err
+	}
+	cmd, err := render(listRunsTpl, struct{ Name string }{Name: shellQuote(task)})
+	if err != nil {
+		return nil, err
+	}
+	b, err := capture(target, cmd)
+	if err != nil {
+		return nil, err
+	}
+	runs := []*TaskRun{}
+	var run *TaskRun
+	for _, line := range strings.Split(string(b), "\n") {
+		step, isStep := parseRollbackStep(strings.TrimSpace(line))
+		switch line = strings.TrimSpace(line); {
+		case isStep && run != nil:
+			run.Rollback = append(run.Rollback, step)
+		case strings.HasSuffix(line, ".done") && run != nil:
+			run.Done = append(run.Done, doneFileToChecksum(line))
+		case strings.HasSuffix(line, ".failed") && run != nil:
+			run.Failed = append(run.Failed, strings.TrimSuffix(filepath.Base(line), ".failed"))
+		case strings.HasPrefix(filepath.Base(line), "build."):
+			run = &TaskRun{ID: strings.TrimPrefix(filepath.Base(line), "build.")}
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+// The task's last run file is truncated, so that all commands starting with the
+// given index are executed again with the next build.
+func (s *targetStateStore) Invalidate(target Target, task string, index int) error {
+	if err := checkTaskName(task); err != nil {
+		return err
+	}
+	if index < 0 {
+		return fmt.Errorf("invalid command index %d", index)
+	}
+	cmd, err := render(invalidateTpl, struct {
+		Name  string
+		Index int
+	}{Name: shellQuote(task), Index: index})
+	if err != nil {
+		return err
+	}
+	_, err = capture(target, cmd)
+	return err
+}
+
+func (s *targetStateStore) Remove(target Target, task string) error {
+	if err := checkTaskName(task); err != nil {
+		return err
+	}
+	cmd, err := render(removeTpl, struct{ Name string }{Name: shellQuote(task)})
+	if err != nil {
+		return err
+	}
+	_, err = capture(target, cmd)
+	return err
+}
+
+func (s *targetStateStore) RunLogs(target Target, task, run string) (map[string][]byte, error) {
+	if err := checkTaskName(task); err != nil {
+		return nil, err
+	}
+	if err := checkTaskName(run); err != nil {
+		return nil, err
+	}
+	cmd, err := render(runLogsTpl, struct{ Name, Run string }{Name: shellQuote(task), Run: shellQuote(run)})
+	if err != nil {
+		return nil, err
+	}
+	b, err := capture(target, cmd)
+	if err != nil {
+		return nil, err
+	}
+	logs := map[string][]byte{}
+	if len(b) == 0 {
+		return logs, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	t := tar.NewReader(gz)
+	for {
+		switch h, err := t.Next(); err {
+		case io.EOF:
+			return logs, nil
+		case nil:
+			b, err := ioutil.ReadAll(t)
+			if err != nil {
+				return nil, err
+			}
+			logs[strings.TrimSuffix(filepath.Base(h.Name), ".log")] = b
+		default:
+			return nil, err
+		}
+	}
+}
+
+// Tasks without run file were provisioned by an earlier version, their
+// commands are ordered by the modification time of the done files (like the
+// migration does).
+func readItemsFromTar(t *tar.Reader) (m map[string]*TaskState, err error) {
+	m = map[string]*TaskState{}
+	done := map[string][]*tar.Header{}
+	for {
+		switch h, err := t.Next(); err {
+		case io.EOF:
+			for name, headers := range done {
+				if m[name].LastRun != "" {
+					continue
+				}
+				sort.Stable(headersByModTime(headers))
+				for _, h := range headers {
+					m[name].Checksums = append(m[name].Checksums, doneFileToChecksum(h.Name))
+				}
+			}
+			return m, nil
+		case nil:
+			name := filepath.Base(filepath.Dir(h.Name))
+			b, err := ioutil.ReadAll(t)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := m[name]; !ok {
+				m[name] = &TaskState{Name: name, Content: map[string]string{}}
+			}
+			switch n := h.Name; {
+			case strings.HasSuffix(n, ".run"):
+				m[name].LastRun = runFileToID(n)
+				m[name].Checksums = parseRunFile(b)
+			case strings.HasSuffix(n, ".done"):
+				m[name].Content[doneFileToChecksum(n)] = parseDoneFile(b)
+				done[name] = append(done[name], h)
+			case strings.HasSuffix(n, ".log") || strings.HasSuffix(n, ".failed"):
+				// ignore for now
+			default:
+				return nil, fmt.Errorf("%s dir=%t has unsupported suffix", n, h.FileInfo().IsDir())
+			}
+		default:
+			return nil, err
+		}
+	}
+}
+
+type headersByModTime []*tar.Header
+
+func (h headersByModTime) Len() int           { return len(h) }
+func (h headersByModTime) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h headersByModTime) Less(i, j int) bool { return h[i].ModTime.Before(h[j].ModTime) }
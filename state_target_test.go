@@ -0,0 +1,179 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dynport/urknall/target"
+)
+
+// Target running all commands with the cache directory replaced by dir.
+type dirTarget struct {
+	Target
+	dir string
+}
+
+func (t dirTarget) Command(cmd string) (target.ExecCommand, error) {
+	return t.Target.Command(strings.Replace(cmd, ukCACHEDIR, t.dir, -1))
+}
+
+func listFiles(t *testing.T, dir string) []string {
+	files := []string{}
+	err := filepath.Walk(dir, func(p string, _ os.FileInfo, err error) error {
+		files = append(files, p)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestTargetStateStoreMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Layout of earlier versions: no run file at all, or a run file
+	// referencing failed commands.
+	write := func(name, content string, mtime time.Time) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("base/b.done", "echo b", now.Add(-2*time.Hour))
+	write("base/a.done", "echo a", now.Add(-time.Hour))
+	write("other/x.done", "echo x", now)
+	write("other/z.done", "echo z", now)
+	write("other/20200101_000000.run", dir+"/other/x.done\n"+dir+"/other/y.failed\n"+dir+"/other/z.done\n", now)
+
+	tgt := dirTarget{Target: target.NewLocalTarget(), dir: dir}
+	s := &targetStateStore{}
+	ex := map[string][]string{"base": {"b", "a"}, "other": {"x"}}
+	check := func(name string) {
+		state, err := s.ReadState(tgt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for task, cs := range ex {
+			if state[task] == nil {
+				t.Errorf("%s: expected state of task %q", name, task)
+			} else if v := state[task].Checksums; !reflect.DeepEqual(v, cs) {
+				t.Errorf("%s: expected checksums of task %q to be %v, got %v", name, task, cs, v)
+			}
+		}
+		if v := state["base"].Content["a"]; v != "echo a" {
+			t.Errorf("%s: expected content %q, got %q", name, "echo a", v)
+		}
+	}
+
+	files := listFiles(t, dir)
+	check("before migration")
+	if v := listFiles(t, dir); !reflect.DeepEqual(v, files) {
+		t.Errorf("expected reading the state not to change files %v, got %v", files, v)
+	}
+
+	if err := s.Prepare(tgt, newRunID(now)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".v3")); err != nil {
+		t.Errorf("expected host to be marked as migrated: %s", err)
+	}
+	for _, task := range []string{"base", "other"} {
+		if runs, _ := filepath.Glob(filepath.Join(dir, task, "*.run")); len(runs) == 0 {
+			t.Errorf("expected run file for task %q", task)
+		}
+	}
+	check("after migration")
+}
+
+func TestParseRunFile(t *testing.T) {
+	in := "# comment\n/var/lib/urknall/base/a.done\n/var/lib/urknall/base/b.failed\n/var/lib/urknall/base/c.done\n"
+	if v, ex := parseRunFile([]byte(in)), []string{"a"}; !reflect.DeepEqual(v, ex) {
+		t.Errorf("expected checksums %v, got %v", ex, v)
+	}
+}
+
+func TestTargetStateStoreLatestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "base"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".v3"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, cs := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "base", cs+".done"), []byte("echo "+cs), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The latest run was recorded with a clock behind the target's clock, the
+	// run file of the previous run has the newer modification time.
+	now := time.Now()
+	runs := []struct {
+		ID    string
+		Done  []string
+		MTime time.Time
+	}{
+		{"20200101_000000", []string{"a", "b"}, now},
+		{"20200101_000100", []string{"a", "b", "c"}, now.Add(-time.Hour)},
+	}
+	for _, r := range runs {
+		lines := []string{}
+		for _, cs := range r.Done {
+			lines = append(lines, filepath.Join(dir, "base", cs+".done"))
+		}
+		p := filepath.Join(dir, "base", r.ID+".run")
+		if err := ioutil.WriteFile(p, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, r.MTime, r.MTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tgt := dirTarget{Target: target.NewLocalTarget(), dir: dir}
+	s := &targetStateStore{}
+	state, err := s.ReadState(tgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := state["base"].LastRun, "20200101_000100"; v != ex {
+		t.Errorf("expected last run %q, got %q", ex, v)
+	}
+	if v, ex := state["base"].Checksums, []string{"a", "b", "c"}; !reflect.DeepEqual(v, ex) {
+		t.Errorf("expected checksums %v, got %v", ex, v)
+	}
+
+	if err := s.Invalidate(tgt, "base", 1); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = s.ReadState(tgt); err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := state["base"].Checksums, []string{"a"}; !reflect.DeepEqual(v, ex) {
+		t.Errorf("expected checksums after invalidation %v, got %v", ex, v)
+	}
+}
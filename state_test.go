@@ -0,0 +1,49 @@
+package urknall
+
+import "testing"
+
+func TestParseTaskRef(t *testing.T) {
+	tasks := map[string]*TaskState{
+		"base":       {Name: "base"},
+		"nginx.1":    {Name: "nginx.1"},
+		"nginx.conf": {Name: "nginx.conf"},
+	}
+	tests := []struct {
+		ref   string
+		task  string
+		index int
+		err   bool
+	}{
+		{"base", "base", 0, false},
+		{"base.2", "base", 2, false},
+		{"nginx.1", "nginx.1", 0, false},
+		{"nginx.1.3", "nginx.1", 3, false},
+		{"nginx.conf.0", "nginx.conf", 0, false},
+		{"base.-1", "", 0, true},
+		{"missing", "", 0, true},
+		{"missing.1", "", 0, true},
+	}
+	for _, tc := range tests {
+		task, index, err := ParseTaskRef(tc.ref, tasks)
+		if (err != nil) != tc.err {
+			t.Errorf("expected error for %q to be %t, got %v", tc.ref, tc.err, err)
+			continue
+		}
+		if task != tc.task || index != tc.index {
+			t.Errorf("expected %q to be parsed to %q/%d, got %q/%d", tc.ref, tc.task, tc.index, task, index)
+		}
+	}
+}
+
+func TestCheckTaskName(t *testing.T) {
+	for _, name := range []string{"base", "nginx.1", "app_2-web", "db:primary"} {
+		if err := checkTaskName(name); err != nil {
+			t.Errorf("expected %q to be valid, got %s", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "a/b", "a b", "a\tb", "x;$(rm -rf ~)", "a`id`", "a|b", "a&b", "a'b", "a\"b", "a*", "a\\b"} {
+		if err := checkTaskName(name); err == nil {
+			t.Errorf("expected %q to be invalid", name)
+		}
+	}
+}
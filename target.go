@@ -14,28 +14,42 @@ type Target interface {
 // Create an SSH target. The address is an identifier of the form
 // `[<user>@?]<host>[:port]`. It is assumed that authentication via public key
 // will work, i.e. the remote host has the building user's public key in its
-// authorized_keys file.
-func NewSshTarget(address string) (Target, error) {
-	return target.NewSshTarget(address)
+// authorized_keys file. Host keys are verified against ~/.ssh/known_hosts,
+// which can be changed using the given options.
+func NewSshTarget(address string, opts ...target.SshOption) (Target, error) {
+	return target.NewSshTarget(address, opts...)
 }
 
 // Create a SSH target with a private access key
-func NewSshTargetWithPrivateKey(address string, key []byte) (Target, error) {
-	return target.NewSshTargetWithPrivateKey(address, key)
+func NewSshTargetWithPrivateKey(address string, key []byte, opts ...target.SshOption) (Target, error) {
+	return target.NewSshTargetWithPrivateKey(address, key, opts...)
 }
 
 // Special SSH target that uses the given password for accessing the machine.
 // This is required mostly for testing and shouldn't be used in production
 // settings.
-func NewSshTargetWithPassword(address, password string) (Target, error) {
-	target, e := target.NewSshTarget(address)
+func NewSshTargetWithPassword(address, password string, opts ...target.SshOption) (Target, error) {
+	target, e := target.NewSshTarget(address, opts...)
 	if e == nil {
 		target.Password = password
 	}
 	return target, e
 }
 
-// Use the local host for building.
-func NewLocalTarget() (Target, error) {
-	return target.NewLocalTarget(), nil
+// Use the local host for building. Commands can be run as a different user
+// using the target.WithRunAsUser option.
+func NewLocalTarget(opts ...target.LocalOption) (Target, error) {
+	return target.NewLocalTarget(opts...), nil
+}
+
+// Use the given running docker container for building. Commands are executed
+// using `docker exec`.
+func NewDockerTarget(container string) (Target, error) {
+	return target.NewDockerTarget(container), nil
+}
+
+// Use the given root directory (a mounted image for example) for building.
+// Commands are executed using chroot or systemd-nspawn (see the options).
+func NewChrootTarget(root string, opts ...target.ChrootOption) (Target, error) {
+	return target.NewChrootTarget(root, opts...), nil
 }
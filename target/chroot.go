@@ -0,0 +1,60 @@
+package target
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Options are used to configure chroot targets.
+type ChrootOption func(*chrootTarget)
+
+// Use systemd-nspawn instead of chroot to execute the commands, so that the
+// commands run in a container with /proc, /sys and /dev set up.
+func WithNspawn() ChrootOption {
+	return func(t *chrootTarget) {
+		t.nspawn = true
+	}
+}
+
+// Create a target executing commands inside the given root directory (a
+// mounted image for example). Commands are always executed as root, using
+// sudo if the build isn't run as root. As the state is kept on the target, it
+// lives inside the image, so that images built with the same templates as
+// live hosts share their state.
+func NewChrootTarget(root string, opts ...ChrootOption) *chrootTarget {
+	t := &chrootTarget{root: root}
+	for _, o := range opts {
+		o(t)
+	}
+	return t
+}
+
+type chrootTarget struct {
+	root   string
+	nspawn bool
+}
+
+func (t *chrootTarget) String() string {
+	return t.root
+}
+
+func (t *chrootTarget) User() string {
+	return "root"
+}
+
+func (t *chrootTarget) Command(cmd string) (ExecCommand, error) {
+	args := []string{"chroot", t.root, "bash", "-c", cmd}
+	if t.nspawn {
+		args = []string{"systemd-nspawn", "--quiet", "--register=no", "--console=pipe", "-D", t.root, "bash", "-c", cmd}
+	}
+	if os.Geteuid() != 0 {
+		args = append([]string{"sudo", "-n"}, args...)
+	} else if !t.nspawn {
+		return newLocalCommand(exec.Command(args[0], args[1:]...)), nil
+	}
+	return newSudoCommand(exec.Command(args[0], args[1:]...)), nil
+}
+
+func (t *chrootTarget) Reset() error {
+	return nil
+}
@@ -0,0 +1,33 @@
+package target
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestChrootTarget(t *testing.T) {
+	prefix := ""
+	if os.Geteuid() != 0 {
+		prefix = "sudo -n "
+	}
+	tests := []struct {
+		target *chrootTarget
+		args   string
+	}{
+		{NewChrootTarget("/mnt/image"), "chroot /mnt/image bash -c echo 1"},
+		{NewChrootTarget("/mnt/image", WithNspawn()), "systemd-nspawn --quiet --register=no --console=pipe -D /mnt/image bash -c echo 1"},
+	}
+	for _, tc := range tests {
+		if v := tc.target.User(); v != "root" {
+			t.Errorf("expected user to be %q, got %q", "root", v)
+		}
+		c, e := tc.target.Command("echo 1")
+		if e != nil {
+			t.Fatal(e)
+		}
+		if v := strings.Join(c.(*localCommand).command.Args, " "); v != prefix+tc.args {
+			t.Errorf("expected command %q, got %q", prefix+tc.args, v)
+		}
+	}
+}
@@ -13,3 +13,9 @@ type ExecCommand interface {
 	Start() error
 	Wait() error
 }
+
+// Commands that can be aborted while running implement the Killer interface.
+// Killing a command must terminate the process on the target.
+type Killer interface {
+	Kill() error
+}
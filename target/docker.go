@@ -0,0 +1,104 @@
+package target
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The docker client binary used by docker targets.
+var dockerBinary = "docker"
+
+// Create a target executing commands in the given running container using
+// `docker exec`. The container must provide bash.
+func NewDockerTarget(container string) *dockerTarget {
+	return &dockerTarget{container: container}
+}
+
+// Start a throwaway container from the given image and create a target for
+// it. The container is removed when the target is closed. The given arguments
+// are passed to `docker run` (like "--privileged").
+func StartDockerTarget(image string, args ...string) (*dockerTarget, error) {
+	runArgs := append([]string{"run", "-d"}, args...)
+	runArgs = append(runArgs, image, "sleep", "infinity")
+	out, err := docker(runArgs...)
+	if err != nil {
+		return nil, err
+	}
+	return &dockerTarget{container: strings.TrimSpace(out), started: true}, nil
+}
+
+type dockerTarget struct {
+	container  string
+	started    bool // whether the container was started by the target
+	cachedUser string
+}
+
+func (t *dockerTarget) String() string {
+	return t.container
+}
+
+// The user commands are executed as (the container's default user).
+func (t *dockerTarget) User() string {
+	if t.cachedUser == "" {
+		out, err := docker("exec", t.container, "id", "-un")
+		if err != nil {
+			return "root"
+		}
+		t.cachedUser = strings.TrimSpace(out)
+	}
+	return t.cachedUser
+}
+
+// Killing the docker client doesn't terminate the process in the container, so
+// the command's shell writes its pid to a file inside the container.
+func (t *dockerTarget) Command(cmd string) (ExecCommand, error) {
+	pidFile, e := newPidFile()
+	if e != nil {
+		return nil, e
+	}
+	c := newLocalCommand(exec.Command(dockerBinary, "exec", "-i", t.container, "bash", "-c", pidFileCmd(pidFile, cmd)))
+	return &dockerCommand{localCommand: c, container: t.container, pidFile: pidFile}, nil
+}
+
+type dockerCommand struct {
+	*localCommand
+	container string
+	pidFile   string
+}
+
+// Kill the process tree of the command inside the container, then the docker
+// client.
+func (c *dockerCommand) Kill() error {
+	_, e := docker("exec", c.container, "bash", "-c", killTreeCmd(c.pidFile))
+	if err := c.localCommand.Kill(); err != nil && e == nil {
+		e = err
+	}
+	return e
+}
+
+func (t *dockerTarget) Reset() error {
+	return nil
+}
+
+// Remove the container if it was started by the target.
+func (t *dockerTarget) Close() error {
+	if !t.started {
+		return nil
+	}
+	_, err := docker("rm", "-f", t.container)
+	return err
+}
+
+func docker(args ...string) (string, error) {
+	out := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	c := exec.Command(dockerBinary, args...)
+	c.Stdout = out
+	c.Stderr = stderr
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("docker %s: %s stderr=%q", args[0], err, stderr.String())
+	}
+	return out.String(), nil
+}
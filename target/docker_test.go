@@ -0,0 +1,123 @@
+package target
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A fake docker client executing commands locally and logging its arguments.
+// Commands are executed in a session of their own, so that killing the client
+// doesn't terminate them (like processes in a container).
+const fakeDocker = `#!/bin/bash
+echo "$@" >> $(dirname $0)/calls
+case $1 in
+  run) echo 4711;;
+  rm) ;;
+  exec)
+    shift; [[ $1 == -i ]] && shift
+    shift
+    exec setsid -w "$@";;
+esac
+`
+
+func installFakeDocker(t *testing.T, dir string) {
+	bin := filepath.Join(dir, "docker")
+	if e := ioutil.WriteFile(bin, []byte(fakeDocker), 0755); e != nil {
+		t.Fatal(e)
+	}
+	dockerBinary = bin
+}
+
+func TestDockerTarget(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	defer func(b string) { dockerBinary = b }(dockerBinary)
+	installFakeDocker(t, dir)
+
+	target, e := StartDockerTarget("ubuntu:16.04", "--privileged")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if v := target.String(); v != "4711" {
+		t.Errorf("expected container to be %q, got %q", "4711", v)
+	}
+	if v := target.User(); v == "" {
+		t.Errorf("expected user to be detected")
+	}
+
+	c, e := target.Command("cat; echo done")
+	if e != nil {
+		t.Fatal(e)
+	}
+	out := &bytes.Buffer{}
+	c.SetStdin(strings.NewReader("input\n"))
+	c.SetStdout(out)
+	if e := c.Run(); e != nil {
+		t.Fatal(e)
+	}
+	if v := out.String(); v != "input\ndone\n" {
+		t.Errorf("expected output %q, got %q", "input\ndone\n", v)
+	}
+	if e := target.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	b, e := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	expected := []string{
+		"run -d --privileged ubuntu:16.04 sleep infinity",
+		"exec 4711 id -un",
+		"exec -i 4711 bash -c echo $$ > /tmp/urknall.",
+		"rm -f 4711",
+	}
+	calls := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(calls) != len(expected) {
+		t.Fatalf("expected docker calls\n%s\ngot\n%s", strings.Join(expected, "\n"), b)
+	}
+	for i, ex := range expected {
+		if !strings.HasPrefix(calls[i], ex) {
+			t.Errorf("expected docker call %d to start with %q, got %q", i, ex, calls[i])
+		}
+	}
+	if !strings.Contains(calls[2], "bash -c 'cat; echo done'") {
+		t.Errorf("expected command to be executed, got %q", calls[2])
+	}
+}
+
+func TestDockerCommandKill(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	defer func(b string) { dockerBinary = b }(dockerBinary)
+	installFakeDocker(t, dir)
+
+	file := filepath.Join(dir, "survived")
+	c, e := NewDockerTarget("4711").Command("sleep 2; touch " + file)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := c.Start(); e != nil {
+		t.Fatal(e)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if e := c.(Killer).Kill(); e != nil {
+		t.Fatal(e)
+	}
+	c.Wait()
+	time.Sleep(2 * time.Second)
+	if _, e := os.Stat(file); e == nil {
+		t.Errorf("expected command in the container to be killed")
+	}
+}
@@ -0,0 +1,56 @@
+package target
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// Signals sent to the process starting a command don't always reach the
+// processes started by the command (e.g. those run with sudo, or in a
+// container or on a remote host). Such commands are run in a shell writing its
+// pid to a file first, so that the process tree can be killed.
+func newPidFile() (string, error) {
+	id := make([]byte, 8)
+	if _, e := rand.Read(id); e != nil {
+		return "", e
+	}
+	return fmt.Sprintf("/tmp/urknall.%x.pid", id), nil
+}
+
+// The command run in a shell writing its pid to the given file.
+func pidFileCmd(pidFile, cmd string) string {
+	return fmt.Sprintf("echo $$ > %[1]s; bash -c %[2]s; status=$?; rm -f %[1]s; exit $status", pidFile, shellQuote(cmd))
+}
+
+// Processes are stopped before being killed so that they can't start new ones
+// in between.
+const killTreeFunc = `kill_tree() {
+  kill -STOP "$1" 2>/dev/null
+  for child in $(pgrep -P "$1"); do
+    kill_tree "$child"
+  done
+  kill -KILL "$1" 2>/dev/null
+}
+`
+
+// The command killing the process tree of the shell that wrote the given pid
+// file.
+func killTreeCmd(pidFile string) string {
+	return sudoScript(fmt.Sprintf("pid=$(cat %[1]s 2>/dev/null) || exit 0\n%[2]skill_tree \"$pid\"\nrm -f %[1]s\n", pidFile, killTreeFunc))
+}
+
+// The command killing the process tree of the process with the given pid.
+func killPidTreeCmd(pid int) string {
+	return sudoScript(fmt.Sprintf("%skill_tree %d\n", killTreeFunc, pid))
+}
+
+// Processes started with sudo can only be killed using sudo.
+func sudoScript(script string) string {
+	q := shellQuote(script)
+	return `if [ "$(id -u)" != 0 ] && sudo -n true 2>/dev/null; then sudo -n bash -c ` + q + `; else bash -c ` + q + `; fi`
+}
+
+func shellQuote(in string) string {
+	return "'" + strings.Replace(in, "'", `'\''`, -1) + "'"
+}
@@ -7,23 +7,53 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/user"
+	"strconv"
 	"strings"
 )
 
+// Options are used to configure local targets.
+type LocalOption func(*localTarget)
+
+// Run the commands as the given user using `sudo -n -u`. The user running the
+// build must be allowed to use sudo without a password. Commands executed as
+// the given user will use sudo for privileged commands, just like on remote
+// targets with that user.
+func WithRunAsUser(user string) LocalOption {
+	return func(t *localTarget) {
+		t.runAs = user
+	}
+}
+
 // Create a target for local provisioning.
-func NewLocalTarget() *localTarget {
-	return &localTarget{}
+func NewLocalTarget(opts ...LocalOption) *localTarget {
+	t := &localTarget{}
+	for _, o := range opts {
+		o(t)
+	}
+	return t
 }
 
 type localTarget struct {
 	cachedUser string
+	runAs      string
 }
 
 func (c *localTarget) String() string {
 	return "LOCAL"
 }
 
+// The user given with WithRunAsUser (empty if not set).
+func (c *localTarget) RunAs() string {
+	return c.runAs
+}
+
+// The user the commands are executed as. This is either the user given as
+// option or the effective user of the current process.
 func (c *localTarget) User() string {
+	if c.runAs != "" {
+		return c.runAs
+	}
 	if c.cachedUser == "" {
 		var err error
 		c.cachedUser, err = whoami()
@@ -35,9 +65,8 @@ func (c *localTarget) User() string {
 }
 
 func whoami() (string, error) {
-	u := os.Getenv("$USER")
-	if u != "" {
-		return u, nil
+	if u, e := user.LookupId(strconv.Itoa(os.Geteuid())); e == nil {
+		return u.Username, nil
 	}
 	out := &bytes.Buffer{}
 	err := &bytes.Buffer{}
@@ -52,9 +81,31 @@ func whoami() (string, error) {
 }
 
 func (c *localTarget) Command(cmd string) (ExecCommand, error) {
-	return &localCommand{
-		command: exec.Command("bash", "-c", cmd),
-	}, nil
+	if c.runAs != "" {
+		current, e := whoami()
+		if e != nil {
+			return nil, e
+		}
+		if current != c.runAs {
+			return newSudoCommand(exec.Command("sudo", "-n", "-H", "-u", c.runAs, "--", "bash", "-c", cmd)), nil
+		}
+	}
+	return newLocalCommand(exec.Command("bash", "-c", cmd)), nil
+}
+
+// Commands are started in a process group of their own, so that all processes
+// started by the command can be killed.
+func newLocalCommand(cmd *exec.Cmd) *localCommand {
+	setProcessGroup(cmd)
+	return &localCommand{command: cmd}
+}
+
+// Commands started with sudo (or in a container) aren't reachable using the
+// process group, their process tree is killed instead.
+func newSudoCommand(cmd *exec.Cmd) *localCommand {
+	c := newLocalCommand(cmd)
+	c.killTree = true
+	return c
 }
 
 func (c *localTarget) Reset() (e error) {
@@ -62,7 +113,8 @@ func (c *localTarget) Reset() (e error) {
 }
 
 type localCommand struct {
-	command *exec.Cmd
+	command  *exec.Cmd
+	killTree bool
 }
 
 func (c *localCommand) StdoutPipe() (io.Reader, error) {
@@ -97,6 +149,25 @@ func (c *localCommand) Start() error {
 	return c.command.Start()
 }
 
+// Kill the command's process group.
+func (c *localCommand) Kill() error {
+	if c.command.Process == nil {
+		return nil
+	}
+	if c.killTree {
+		if out, e := exec.Command("bash", "-c", killPidTreeCmd(c.command.Process.Pid)).CombinedOutput(); e != nil {
+			return fmt.Errorf("error killing command: %s %q", e, out)
+		}
+		// The process group of sudo can't be killed without sudo, the tree
+		// is gone already anyway.
+		if e := killProcessGroup(c.command.Process); e != nil && !os.IsPermission(e) {
+			return e
+		}
+		return nil
+	}
+	return killProcessGroup(c.command.Process)
+}
+
 func (c *localCommand) Run() error {
 	return c.command.Run()
 }
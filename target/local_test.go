@@ -0,0 +1,107 @@
+package target
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalCommandKill(t *testing.T) {
+	c, e := NewLocalTarget().Command("sleep 10")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := c.Start(); e != nil {
+		t.Fatal(e)
+	}
+	started := time.Now()
+	if e := c.(Killer).Kill(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if e := c.Wait(); e == nil {
+		t.Errorf("expected killed command to return an error")
+	}
+	if d := time.Since(started); d > 5*time.Second {
+		t.Errorf("expected command to be killed immediately, took %s", d)
+	}
+}
+
+// A fake sudo executing commands in a session of their own, so that killing
+// the process group doesn't terminate them (like processes of other users).
+const fakeSudo = `#!/bin/bash
+while [[ $1 == -* ]]; do
+  case $1 in
+    -u) shift 2;;
+    --) shift; break;;
+    *) shift;;
+  esac
+done
+exec setsid -w "$@"
+`
+
+func TestLocalCommandKillSudo(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	if e := ioutil.WriteFile(filepath.Join(dir, "sudo"), []byte(fakeSudo), 0755); e != nil {
+		t.Fatal(e)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	file := filepath.Join(dir, "survived")
+	c, e := NewLocalTarget(WithRunAsUser("nobody-else")).Command("sleep 2; touch " + file)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := c.Start(); e != nil {
+		t.Fatal(e)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if e := c.(Killer).Kill(); e != nil {
+		t.Fatal(e)
+	}
+	c.Wait()
+	time.Sleep(2 * time.Second)
+	if _, e := os.Stat(file); e == nil {
+		t.Errorf("expected command started with sudo to be killed")
+	}
+}
+
+func TestLocalTargetUser(t *testing.T) {
+	out, e := exec.Command("id", "-un").Output()
+	if e != nil {
+		t.Fatal(e)
+	}
+	current := strings.TrimSpace(string(out))
+	if v := NewLocalTarget().User(); v != current {
+		t.Errorf("expected user to be %q, got %q", current, v)
+	}
+
+	tests := []struct {
+		runAs, user, args string
+	}{
+		{"", current, "bash -c echo 1"},
+		{current, current, "bash -c echo 1"},
+		{"nobody-else", "nobody-else", "sudo -n -H -u nobody-else -- bash -c echo 1"},
+	}
+	for _, tc := range tests {
+		target := NewLocalTarget(WithRunAsUser(tc.runAs))
+		if v := target.User(); v != tc.user {
+			t.Errorf("expected user to be %q, got %q", tc.user, v)
+		}
+		c, e := target.Command("echo 1")
+		if e != nil {
+			t.Fatal(e)
+		}
+		if v := strings.Join(c.(*localCommand).command.Args, " "); v != tc.args {
+			t.Errorf("expected command %q, got %q", tc.args, v)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package target
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(p *os.Process) error {
+	if e := syscall.Kill(-p.Pid, syscall.SIGKILL); e != nil && e != syscall.ESRCH {
+		return os.NewSyscallError("kill", e)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package target
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// There are no process groups on windows, only the process itself is killed.
+func killProcessGroup(p *os.Process) error {
+	if e := p.Kill(); e != nil && e != os.ErrProcessDone {
+		return e
+	}
+	return nil
+}
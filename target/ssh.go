@@ -1,19 +1,23 @@
 package target
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
-func NewSshTargetWithPrivateKey(addr string, key []byte) (target *sshTarget, err error) {
-	t, err := NewSshTarget(addr)
+func NewSshTargetWithPrivateKey(addr string, key []byte, opts ...SshOption) (target *sshTarget, err error) {
+	t, err := NewSshTarget(addr, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -21,10 +25,14 @@ func NewSshTargetWithPrivateKey(addr string, key []byte) (target *sshTarget, err
 	return t, nil
 }
 
-// Create a target for provisioning via SSH.
-func NewSshTarget(addr string) (target *sshTarget, e error) {
+// Create a target for provisioning via SSH. Host aliases are resolved using
+// ~/.ssh/config, but values given with the address take precedence. Host keys
+// are verified against ~/.ssh/known_hosts unless configured otherwise using
+// the given options.
+func NewSshTarget(addr string, opts ...SshOption) (target *sshTarget, e error) {
 	target = &sshTarget{port: 22, user: "root"}
 
+	portSet := false
 	hostAndPort := strings.SplitN(addr, ":", 2)
 	if len(hostAndPort) == 2 {
 		addr = hostAndPort[0]
@@ -32,8 +40,10 @@ func NewSshTarget(addr string) (target *sshTarget, e error) {
 		if e != nil {
 			return nil, fmt.Errorf("port must be given as integer, got %q", hostAndPort[1])
 		}
+		portSet = true
 	}
 
+	userSet := false
 	userAndAddress := strings.Split(addr, "@")
 	switch len(userAndAddress) {
 	case 1:
@@ -41,6 +51,7 @@ func NewSshTarget(addr string) (target *sshTarget, e error) {
 	case 2:
 		target.user = userAndAddress[0]
 		target.address = userAndAddress[1]
+		userSet = true
 	default:
 		return nil, fmt.Errorf("expected target address of the form '<user>@<host>', but was given: %s", addr)
 	}
@@ -49,19 +60,67 @@ func NewSshTarget(addr string) (target *sshTarget, e error) {
 		e = fmt.Errorf("empty address given for target")
 	}
 
-	return target, e
+	if e != nil {
+		return target, e
+	}
+	for _, o := range opts {
+		o(target)
+	}
+	if !target.noConfig {
+		c, e := target.readSshConfig()
+		if e != nil {
+			return nil, e
+		}
+		if c != nil {
+			if e := target.applySshConfig(c, userSet, portSet); e != nil {
+				return nil, e
+			}
+		}
+	}
+	for _, j := range target.jumps {
+		hop, e := j(target)
+		if e != nil {
+			return nil, e
+		}
+		target.jumpHosts = append(target.jumpHosts, hop)
+	}
+	return target, nil
 }
 
 type sshTarget struct {
 	Password string
 
-	user    string
-	port    int
-	address string
+	user     string
+	port     int
+	address  string
+	hostname string // host to connect to if different from the address (from the SSH config)
+
+	key            []byte
+	identityFiles  []string
+	identitiesOnly bool
+
+	configFile string
+	noConfig   bool
 
-	key []byte
+	knownHosts    string
+	hostKey       ssh.PublicKey
+	hostKeyPolicy HostKeyPolicy
 
-	client *ssh.Client
+	jumps      []func(*sshTarget) (*sshTarget, error) // jump hosts created after all options are applied
+	jumpHosts  []*sshTarget
+	isJumpHost bool
+	dial       Dialer
+
+	keepAliveInterval time.Duration
+	keepAliveMax      int
+	retries           int
+	retryBackoff      time.Duration
+	timeout           time.Duration
+
+	mutex         sync.Mutex // guards the clients
+	client        *ssh.Client
+	jumpClients   []*ssh.Client
+	stopKeepAlive chan struct{}
 }
 
 func (target *sshTarget) User() string {
@@ -72,37 +131,102 @@ func (target *sshTarget) String() string {
 	return target.address
 }
 
+// A new session is opened for every command. If the session can't be opened,
+// the connection is assumed to be dropped and established again.
 func (target *sshTarget) Command(cmd string) (ExecCommand, error) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	connected := false
 	if target.client == nil {
-		var e error
-		target.client, e = target.buildClient()
-		if e != nil {
+		if e := target.connectWithRetry(); e != nil {
 			return nil, e
 		}
+		connected = true
 	}
 	ses, e := target.client.NewSession()
+	if e != nil && !connected {
+		target.reset()
+		if e := target.connectWithRetry(); e != nil {
+			return nil, e
+		}
+		ses, e = target.client.NewSession()
+	}
 	if e != nil {
 		return nil, e
 	}
-	return &sshCommand{command: cmd, session: ses}, nil
+	return &sshCommand{command: cmd, session: ses, client: target.client}, nil
 }
 
 func (target *sshTarget) Reset() (e error) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	return target.reset()
+}
+
+func (target *sshTarget) reset() (e error) {
+	if target.stopKeepAlive != nil {
+		close(target.stopKeepAlive)
+		target.stopKeepAlive = nil
+	}
 	if target.client != nil {
 		e = target.client.Close()
 		target.client = nil
 	}
+	for i := len(target.jumpClients) - 1; i >= 0; i-- {
+		target.jumpClients[i].Close()
+	}
+	target.jumpClients = nil
 	return e
 }
 
+// The connection to the target is tunneled through the jump hosts (if any),
+// each connection being established through the previous one. The first
+// connection is made using the target's dialer.
 func (target *sshTarget) buildClient() (*ssh.Client, error) {
-	var e error
+	dial := target.dial
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: target.connectTimeout()}).Dial
+	}
+	clients := []*ssh.Client{}
+	for _, hop := range append(append([]*sshTarget{}, target.jumpHosts...), target) {
+		c, e := hop.connect(dial)
+		if e != nil {
+			for i := len(clients) - 1; i >= 0; i-- {
+				clients[i].Close()
+			}
+			if hop != target {
+				return nil, fmt.Errorf("connecting to jump host %s: %s", hop.address, e)
+			}
+			return nil, e
+		}
+		clients = append(clients, c)
+		dial = c.Dial
+	}
+	target.jumpClients = clients[:len(clients)-1]
+	return clients[len(clients)-1], nil
+}
+
+func (target *sshTarget) connect(dial Dialer) (*ssh.Client, error) {
+	hostKeyCallback, algorithms, e := target.hostKeyCallback()
+	if e != nil {
+		return nil, e
+	}
+	// The handshake error does not wrap the callback's error, so a host key
+	// error is kept to be returned as is.
+	var hostKeyErr error
 	config := &ssh.ClientConfig{
-		User:            target.user,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User: target.user,
+		HostKeyCallback: func(host string, remote net.Addr, key ssh.PublicKey) error {
+			err := hostKeyCallback(host, remote, key)
+			if _, ok := err.(*HostKeyError); ok {
+				hostKeyErr = err
+			}
+			return err
+		},
 	}
 
 	signers := []ssh.Signer{}
+	agentSigners := []ssh.Signer{}
 	if target.Password != "" {
 		config.Auth = append(config.Auth, ssh.Password(target.Password))
 	} else if sshSocket := os.Getenv("SSH_AUTH_SOCK"); sshSocket != "" {
@@ -111,9 +235,13 @@ func (target *sshTarget) buildClient() (*ssh.Client, error) {
 			if err != nil {
 				return nil, err
 			}
-			signers = append(signers, s...)
+			agentSigners = s
 		}
 	}
+	// With IdentitiesOnly set, only agent keys of identity files are used.
+	if !target.identitiesOnly {
+		signers = append(signers, agentSigners...)
+	}
 	if len(target.key) > 0 {
 		key, err := ssh.ParsePrivateKey(target.key)
 		if err != nil {
@@ -121,27 +249,116 @@ func (target *sshTarget) buildClient() (*ssh.Client, error) {
 		}
 		signers = append(signers, key)
 	}
+	for _, f := range target.identityFiles {
+		b, err := ioutil.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		key, err := ssh.ParsePrivateKey(b)
+		if pe, ok := err.(*ssh.PassphraseMissingError); ok {
+			// Encrypted keys are used via the agent if it holds them.
+			if s := agentSigner(f, pe, agentSigners); s != nil && target.identitiesOnly {
+				signers = append(signers, s)
+			}
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("reading identity file %s: %s", f, err)
+		}
+		signers = append(signers, key)
+	}
 
 	if len(signers) > 0 {
 		config.Auth = append(config.Auth, ssh.PublicKeys(signers...))
 	}
 
-	con, e := ssh.Dial("tcp", fmt.Sprintf("%s:%d", target.address, target.port), config)
+	host := target.address
+	if target.hostname != "" {
+		host = target.hostname
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(target.port))
+	conn, e := dial("tcp", addr)
 	if e != nil {
 		return nil, e
 	}
-	return &ssh.Client{Conn: con}, nil
+	if algorithms != nil {
+		config.HostKeyAlgorithms = algorithms(addr, conn.RemoteAddr())
+	}
+	// The deadline prevents hanging on hosts accepting connections without
+	// responding (e.g. while booting).
+	conn.SetDeadline(time.Now().Add(target.connectTimeout()))
+	c, chans, reqs, e := ssh.NewClientConn(conn, addr, config)
+	conn.SetDeadline(time.Time{})
+	if e != nil {
+		conn.Close()
+		if hostKeyErr != nil {
+			return nil, hostKeyErr
+		}
+		return nil, e
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// The agent's signer for the encrypted identity file. The public key is taken
+// from the key file if available, from the file with suffix .pub otherwise.
+func agentSigner(f string, e *ssh.PassphraseMissingError, agentSigners []ssh.Signer) ssh.Signer {
+	pub := e.PublicKey
+	if pub == nil {
+		b, err := ioutil.ReadFile(f + ".pub")
+		if err != nil {
+			return nil
+		}
+		if pub, _, _, _, err = ssh.ParseAuthorizedKey(b); err != nil {
+			return nil
+		}
+	}
+	for _, s := range agentSigners {
+		if bytes.Equal(s.PublicKey().Marshal(), pub.Marshal()) {
+			return s
+		}
+	}
+	return nil
 }
 
 type sshCommand struct {
 	command string
 	session *ssh.Session
+	client  *ssh.Client
+	pidFile string // where the remote shell's pid is written to by Start
 }
 
 func (c *sshCommand) Close() error {
 	return c.session.Close()
 }
 
+// Kill the process tree of the command on the remote host using a second
+// session (signals sent to the session don't reach processes started with
+// sudo), then send SIGKILL to the session and close it (not all servers
+// support signals).
+func (c *sshCommand) Kill() error {
+	var e error
+	if c.pidFile != "" {
+		e = c.killTree()
+	}
+	if err := c.session.Signal(ssh.SIGKILL); err != nil && e == nil {
+		e = err
+	}
+	if err := c.session.Close(); err != nil && err != io.EOF && e == nil {
+		e = err
+	}
+	return e
+}
+
+func (c *sshCommand) killTree() error {
+	ses, e := c.client.NewSession()
+	if e != nil {
+		return e
+	}
+	defer ses.Close()
+	return ses.Run(killTreeCmd(c.pidFile))
+}
+
 func (c *sshCommand) StdinPipe() (io.WriteCloser, error) {
 	return c.session.StdinPipe()
 }
@@ -174,6 +391,16 @@ func (c *sshCommand) Wait() error {
 	return c.session.Wait()
 }
 
+// The command is started in a shell writing its pid to a file first, so that
+// the command can be killed.
 func (c *sshCommand) Start() error {
-	return c.session.Start(c.command)
+	if c.client == nil {
+		return c.session.Start(c.command)
+	}
+	pidFile, e := newPidFile()
+	if e != nil {
+		return e
+	}
+	c.pidFile = pidFile
+	return c.session.Start(pidFileCmd(c.pidFile, c.command))
 }
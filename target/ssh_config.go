@@ -0,0 +1,168 @@
+package target
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Read the given OpenSSH client configuration file instead of ~/.ssh/config.
+func WithSshConfigFile(path string) SshOption {
+	return func(t *sshTarget) {
+		t.configFile = path
+	}
+}
+
+// Don't read any OpenSSH client configuration file.
+func WithoutSshConfig() SshOption {
+	return func(t *sshTarget) {
+		t.noConfig = true
+	}
+}
+
+// A minimal parser of OpenSSH client configuration files. Only the Host
+// sections (and the options before the first one) are supported, Match
+// sections are ignored.
+type sshConfig struct {
+	sections []*sshConfigSection
+}
+
+type sshConfigSection struct {
+	patterns []string
+	options  [][2]string // pairs of lower case keyword and value
+}
+
+func parseSshConfig(r io.Reader) (*sshConfig, error) {
+	c := &sshConfig{}
+	current := &sshConfigSection{patterns: []string{"*"}}
+	c.sections = append(c.sections, current)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		i := strings.IndexAny(l, " \t=")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: missing value for %q", line, l)
+		}
+		key := strings.ToLower(l[:i])
+		value := strings.TrimLeft(strings.TrimSpace(l[i:]), "=")
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch key {
+		case "host":
+			current = &sshConfigSection{patterns: strings.Fields(value)}
+			c.sections = append(c.sections, current)
+		case "match":
+			current = &sshConfigSection{}
+		default:
+			current.options = append(current.options, [2]string{key, value})
+		}
+	}
+	return c, scanner.Err()
+}
+
+func (s *sshConfigSection) matches(host string) bool {
+	matched := false
+	for _, p := range s.patterns {
+		negated := strings.HasPrefix(p, "!")
+		if ok, _ := path.Match(strings.TrimPrefix(p, "!"), host); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// The options for the given host. As with OpenSSH, the first value obtained
+// for an option is used, except for identity files which are all collected.
+func (c *sshConfig) lookup(host string) map[string][]string {
+	m := map[string][]string{}
+	for _, s := range c.sections {
+		if !s.matches(host) {
+			continue
+		}
+		for _, o := range s.options {
+			if _, ok := m[o[0]]; !ok || o[0] == "identityfile" {
+				m[o[0]] = append(m[o[0]], o[1])
+			}
+		}
+	}
+	return m
+}
+
+func (target *sshTarget) readSshConfig() (*sshConfig, error) {
+	p := target.configFile
+	if p == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		p = filepath.Join(home, ".ssh", "config")
+	}
+	f, err := os.Open(p)
+	switch {
+	case os.IsNotExist(err) && target.configFile == "":
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+	c, err := parseSshConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", p, err)
+	}
+	return c, nil
+}
+
+// Apply the options of the configuration file to the target. Values given
+// explicitly with the target's address take precedence. Jump hosts given in the
+// configuration are only used if none were given as option.
+func (target *sshTarget) applySshConfig(c *sshConfig, userSet, portSet bool) error {
+	opts := c.lookup(target.address)
+	first := func(key string) string {
+		if v := opts[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	if v := first("hostname"); v != "" {
+		target.hostname = strings.Replace(v, "%h", target.address, -1)
+	}
+	if v := first("user"); v != "" && !userSet {
+		target.user = v
+	}
+	if v := first("port"); v != "" && !portSet {
+		p, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("port of %s must be given as integer, got %q", target.address, v)
+		}
+		target.port = p
+	}
+	for _, f := range opts["identityfile"] {
+		target.identityFiles = append(target.identityFiles, expandHome(f))
+	}
+	target.identitiesOnly = strings.ToLower(first("identitiesonly")) == "yes"
+	if v := first("proxyjump"); v != "" && v != "none" && len(target.jumps) == 0 && !target.isJumpHost {
+		for _, addr := range strings.Split(v, ",") {
+			target.jumps = append(target.jumps, jumpHost(strings.TrimSpace(addr)))
+		}
+	}
+	return nil
+}
+
+func expandHome(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, p[1:])
+		}
+	}
+	return p
+}
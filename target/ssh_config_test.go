@@ -0,0 +1,252 @@
+package target
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const testSshConfig = `
+# global options
+IdentitiesOnly yes
+
+Host web* !web3
+  HostName %h.example.com
+  User deploy
+  Port 2222
+  IdentityFile ~/.ssh/web
+
+Host db
+  HostName=10.0.0.5
+  ProxyJump bastion
+  User "admin"
+
+Match host foo
+  User ignored
+
+Host *
+  User fallback
+  IdentityFile /keys/default
+`
+
+func TestSshConfigLookup(t *testing.T) {
+	c, e := parseSshConfig(strings.NewReader(testSshConfig))
+	if e != nil {
+		t.Fatal(e)
+	}
+	tests := []struct {
+		host, key, value string
+	}{
+		{"web1", "hostname", "%h.example.com"},
+		{"web1", "user", "deploy"},
+		{"web1", "port", "2222"},
+		{"web1", "identityfile", "~/.ssh/web,/keys/default"},
+		{"web1", "identitiesonly", "yes"},
+		{"web3", "user", "fallback"},
+		{"web3", "hostname", ""},
+		{"db", "hostname", "10.0.0.5"},
+		{"db", "user", "admin"},
+		{"db", "proxyjump", "bastion"},
+		{"foo", "user", "fallback"},
+	}
+	for _, tc := range tests {
+		if v := strings.Join(c.lookup(tc.host)[tc.key], ","); v != tc.value {
+			t.Errorf("expected %s of %s to be %q, got %q", tc.key, tc.host, tc.value, v)
+		}
+	}
+}
+
+func TestNewSshTargetWithConfig(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config")
+	if e := ioutil.WriteFile(config, []byte(testSshConfig), 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	tests := []struct {
+		addr, user, hostname string
+		port                 int
+		jumps                int
+	}{
+		{"web1", "deploy", "web1.example.com", 2222, 0},
+		{"root@web1:22", "root", "web1.example.com", 22, 0},
+		{"db", "admin", "10.0.0.5", 22, 1},
+		{"other", "fallback", "", 22, 0},
+	}
+	for _, tc := range tests {
+		target, e := NewSshTarget(tc.addr, WithSshConfigFile(config))
+		if e != nil {
+			t.Fatal(e)
+		}
+		if target.user != tc.user || target.hostname != tc.hostname || target.port != tc.port || len(target.jumpHosts) != tc.jumps {
+			t.Errorf("expected %s to be %s@%s:%d with %d jump hosts, got %s@%s:%d with %d jump hosts",
+				tc.addr, tc.user, tc.hostname, tc.port, tc.jumps, target.user, target.hostname, target.port, len(target.jumpHosts))
+		}
+	}
+
+	target, e := NewSshTarget("db", WithSshConfigFile(config), WithJumpHost("other"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(target.jumpHosts) != 1 || target.jumpHosts[0].address != "other" {
+		t.Errorf("expected explicit jump host to replace the configured one")
+	}
+
+	target, e = NewSshTarget("web1", WithoutSshConfig())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if target.user != "root" || target.hostname != "" {
+		t.Errorf("expected config to be ignored, got %s@%s", target.user, target.hostname)
+	}
+}
+
+func TestSshConnectWithConfig(t *testing.T) {
+	s := newTestSshServer(t)
+	defer s.Close()
+	jump := newTestSshServer(t)
+	defer jump.Close()
+
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	host, port := splitTestAddr(t, s.addr)
+	jumpHost, jumpPort := splitTestAddr(t, jump.addr)
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	der, e := x509.MarshalECPrivateKey(key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	identity := filepath.Join(dir, "id_ecdsa")
+	if e := ioutil.WriteFile(identity, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	config := filepath.Join(dir, "config")
+	content := "Host app\n  HostName " + host + "\n  Port " + port + "\n  ProxyJump bastion\n" +
+		"Host bastion\n  HostName " + jumpHost + "\n  Port " + jumpPort + "\n  IdentityFile " + identity + "\n"
+	if e := ioutil.WriteFile(config, []byte(content), 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	// The target is accessed using a password, the jump host using the
+	// identity file of the config.
+	out, e := runTestCommand("app", WithSshConfigFile(config), WithHostKeyPolicy(HostKeyInsecure))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if out != "echo hello" {
+		t.Errorf("expected output %q, got %q", "echo hello", out)
+	}
+	if v := strings.Join(jump.Forwards(), ","); v != s.addr {
+		t.Errorf("expected jump host to forward to %q, got %q", s.addr, v)
+	}
+}
+
+func splitTestAddr(t *testing.T, addr string) (string, string) {
+	host, port, e := net.SplitHostPort(addr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return host, port
+}
+
+// Start an agent holding the given key and point SSH_AUTH_SOCK to it.
+func startTestAgent(t *testing.T, dir string, key interface{}) func() {
+	keyring := agent.NewKeyring()
+	if e := keyring.Add(agent.AddedKey{PrivateKey: key}); e != nil {
+		t.Fatal(e)
+	}
+	l, e := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, c)
+		}
+	}()
+	old := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", l.Addr().String())
+	return func() {
+		os.Setenv("SSH_AUTH_SOCK", old)
+		l.Close()
+	}
+}
+
+func TestSshConnectWithEncryptedIdentity(t *testing.T) {
+	s := newTestSshServer(t)
+	defer s.Close()
+
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	der, e := x509.MarshalECPrivateKey(key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	block, e := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", der, []byte("passphrase"), x509.PEMCipherAES256)
+	if e != nil {
+		t.Fatal(e)
+	}
+	identity := filepath.Join(dir, "id_ecdsa")
+	if e := ioutil.WriteFile(identity, pem.EncodeToMemory(block), 0600); e != nil {
+		t.Fatal(e)
+	}
+	pub, e := ssh.NewPublicKey(&key.PublicKey)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := ioutil.WriteFile(identity+".pub", ssh.MarshalAuthorizedKey(pub), 0644); e != nil {
+		t.Fatal(e)
+	}
+	defer startTestAgent(t, dir, key)()
+
+	host, port := splitTestAddr(t, s.addr)
+	config := filepath.Join(dir, "config")
+	content := "Host app\n  HostName " + host + "\n  Port " + port + "\n  IdentityFile " + identity + "\n  IdentitiesOnly yes\n"
+	if e := ioutil.WriteFile(config, []byte(content), 0600); e != nil {
+		t.Fatal(e)
+	}
+	// Only the agent's key of the encrypted identity file can be used.
+	target, e := NewSshTarget("app", WithSshConfigFile(config), WithHostKeyPolicy(HostKeyInsecure))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer target.Reset()
+	if e := runOn(target, "echo hello"); e != nil {
+		t.Fatalf("expected the agent's key to be used, got %s", e)
+	}
+}
@@ -0,0 +1,164 @@
+package target
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultConnectTimeout = 30 * time.Second
+	defaultRetryBackoff   = time.Second
+	maxRetryBackoff       = 30 * time.Second
+)
+
+// Send keepalive requests in the given interval. The connection is closed
+// (and established again for the next command) if max requests in a row are
+// not answered (3 if not positive).
+func WithKeepAlive(interval time.Duration, max int) SshOption {
+	if max < 1 {
+		max = 3
+	}
+	return func(t *sshTarget) {
+		t.keepAliveInterval = interval
+		t.keepAliveMax = max
+	}
+}
+
+// Retry connecting to the target the given number of times. The time waited
+// between attempts starts with the given backoff and is doubled with every
+// attempt. Host key and authentication errors are not retried.
+func WithRetry(retries int, backoff time.Duration) SshOption {
+	return func(t *sshTarget) {
+		t.retries = retries
+		t.retryBackoff = backoff
+	}
+}
+
+// Timeout for establishing a connection (including the SSH handshake). The
+// default is 30 seconds.
+func WithConnectTimeout(timeout time.Duration) SshOption {
+	return func(t *sshTarget) {
+		t.timeout = timeout
+	}
+}
+
+// Targets that can be waited for to become reachable (e.g. after a reboot)
+// implement the Waiter interface.
+type Waiter interface {
+	WaitUntilReachable(timeout time.Duration) error
+}
+
+// Drop the current connection and wait until a new one can be established.
+// This is used to wait for the host to return after a reboot.
+func (target *sshTarget) WaitUntilReachable(timeout time.Duration) error {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	target.reset()
+	deadline := time.Now().Add(timeout)
+	backoff := target.backoff()
+	for {
+		c, e := target.buildClient()
+		switch {
+		case e == nil:
+			target.setClient(c)
+			return nil
+		case !retryable(e):
+			return e
+		case time.Now().Add(backoff).After(deadline):
+			return fmt.Errorf("%s not reachable after %s: %s", target.address, timeout, e)
+		}
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func (target *sshTarget) connectWithRetry() error {
+	backoff := target.backoff()
+	for attempt := 0; ; attempt++ {
+		c, e := target.buildClient()
+		switch {
+		case e == nil:
+			target.setClient(c)
+			return nil
+		case attempt >= target.retries || !retryable(e):
+			return e
+		}
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func (target *sshTarget) setClient(c *ssh.Client) {
+	target.client = c
+	if target.keepAliveInterval > 0 {
+		target.stopKeepAlive = make(chan struct{})
+		go keepAlive(c, target.keepAliveInterval, target.keepAliveMax, target.stopKeepAlive)
+	}
+}
+
+func (target *sshTarget) connectTimeout() time.Duration {
+	if target.timeout > 0 {
+		return target.timeout
+	}
+	return defaultConnectTimeout
+}
+
+func (target *sshTarget) backoff() time.Duration {
+	if target.retryBackoff > 0 {
+		return target.retryBackoff
+	}
+	return defaultRetryBackoff
+}
+
+func nextBackoff(b time.Duration) time.Duration {
+	if b *= 2; b > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return b
+}
+
+// Errors caused by the host's key or the credentials won't go away by trying
+// again.
+func retryable(e error) bool {
+	if _, ok := e.(*HostKeyError); ok {
+		return false
+	}
+	return !strings.Contains(e.Error(), "unable to authenticate")
+}
+
+func keepAlive(c *ssh.Client, interval time.Duration, max int, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	missed := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+		select {
+		case <-stop:
+			return
+		case err := <-replied:
+			if err != nil {
+				missed++
+			} else {
+				missed = 0
+			}
+		case <-time.After(interval):
+			missed++
+		}
+		if missed >= max {
+			c.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package target
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An address nothing listens on (yet).
+func freeTestAddr(t *testing.T) string {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func newTestTarget(t *testing.T, addr string, opts ...SshOption) *sshTarget {
+	target, e := NewSshTarget("root@"+addr, append([]SshOption{WithoutSshConfig(), WithHostKeyPolicy(HostKeyInsecure)}, opts...)...)
+	if e != nil {
+		t.Fatal(e)
+	}
+	target.Password = "secret"
+	return target
+}
+
+func runOn(target *sshTarget, cmd string) error {
+	c, e := target.Command(cmd)
+	if e != nil {
+		return e
+	}
+	return c.Run()
+}
+
+func TestSshReconnect(t *testing.T) {
+	s := newTestSshServer(t)
+	defer s.Close()
+
+	target := newTestTarget(t, s.addr)
+	defer target.Reset()
+	if e := runOn(target, "first"); e != nil {
+		t.Fatal(e)
+	}
+	s.DropConnections()
+	// Wait for the client to notice the connection is gone.
+	target.client.Wait()
+	if e := runOn(target, "second"); e != nil {
+		t.Fatalf("expected command to succeed after reconnect, got %s", e)
+	}
+	if v := strings.Join(s.Commands(), ","); v != "first,second" {
+		t.Errorf("expected commands %q, got %q", "first,second", v)
+	}
+}
+
+func TestSshRetry(t *testing.T) {
+	addr := freeTestAddr(t)
+	started := make(chan *testSshServer, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		started <- newTestSshServerAt(t, addr)
+	}()
+	defer func() { (<-started).Close() }()
+
+	target := newTestTarget(t, addr, WithRetry(10, 50*time.Millisecond))
+	defer target.Reset()
+	if e := runOn(target, "true"); e != nil {
+		t.Fatalf("expected command to succeed with retries, got %s", e)
+	}
+
+	target = newTestTarget(t, freeTestAddr(t))
+	if e := runOn(target, "true"); e == nil {
+		t.Errorf("expected error without retries")
+	}
+}
+
+func TestSshRetryAuthentication(t *testing.T) {
+	s := newTestSshServer(t)
+	defer s.Close()
+
+	target := newTestTarget(t, s.addr, WithRetry(10, time.Second))
+	target.Password = "wrong"
+	started := time.Now()
+	if e := runOn(target, "true"); e == nil {
+		t.Errorf("expected authentication error")
+	}
+	if d := time.Since(started); d > time.Second {
+		t.Errorf("expected authentication errors not to be retried, took %s", d)
+	}
+}
+
+func TestSshWaitUntilReachable(t *testing.T) {
+	s := newTestSshServer(t)
+	target := newTestTarget(t, s.addr, WithRetry(0, 50*time.Millisecond))
+	defer target.Reset()
+	if e := runOn(target, "reboot"); e != nil {
+		t.Fatal(e)
+	}
+	s.Close()
+
+	if e := target.WaitUntilReachable(200 * time.Millisecond); e == nil {
+		t.Fatalf("expected host to be unreachable")
+	}
+
+	started := make(chan *testSshServer, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		started <- newTestSshServerAt(t, s.addr)
+	}()
+	defer func() { (<-started).Close() }()
+	if e := target.WaitUntilReachable(5 * time.Second); e != nil {
+		t.Fatalf("expected host to be reachable again, got %s", e)
+	}
+	if e := runOn(target, "true"); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestSshKeepAlive(t *testing.T) {
+	s := newTestSshServer(t)
+	defer s.Close()
+
+	target := newTestTarget(t, s.addr, WithKeepAlive(20*time.Millisecond, 3))
+	defer target.Reset()
+	if e := runOn(target, "true"); e != nil {
+		t.Fatal(e)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if n := s.KeepAlives(); n < 2 {
+		t.Errorf("expected at least %d keepalive requests, got %d", 2, n)
+	}
+}
+
+func TestSshCommandKill(t *testing.T) {
+	s := newTestSshServer(t)
+	defer s.Close()
+
+	dir, e := ioutil.TempDir("", "urknall-ssh-kill")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	target := newTestTarget(t, s.addr)
+	defer target.Reset()
+	c, e := target.Command(fmt.Sprintf("(sleep 1 && touch %[1]s/bg) & sleep 1; touch %[1]s/fg", dir))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := c.Start(); e != nil {
+		t.Fatal(e)
+	}
+	c.Wait()
+	// The test server only echoes the commands, so they are run locally.
+	started := s.Commands()
+	if len(started) != 1 || !strings.Contains(started[0], "> /tmp/urknall.") {
+		t.Fatalf("expected command to write its pid, got %q", started)
+	}
+	remote := exec.Command("bash", "-c", started[0])
+	if e := remote.Start(); e != nil {
+		t.Fatal(e)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	c.(Killer).Kill()
+	commands := s.Commands()
+	if len(commands) != 2 || !strings.Contains(commands[1], "kill_tree") {
+		t.Fatalf("expected kill command to be run, got %q", commands)
+	}
+	if out, e := exec.Command("bash", "-c", commands[1]).CombinedOutput(); e != nil {
+		t.Fatalf("expected kill command to succeed, got %s: %s", e, out)
+	}
+	if e := remote.Wait(); e == nil {
+		t.Errorf("expected killed command to return an error")
+	}
+	time.Sleep(1200 * time.Millisecond)
+	for _, name := range []string{"fg", "bg"} {
+		if _, e := os.Stat(filepath.Join(dir, name)); e == nil {
+			t.Errorf("expected file %q not to be created by the killed command", name)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package target
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// A dialer creates the connection to an SSH server. The network is always
+// "tcp" and the address is given as host:port.
+type Dialer func(network, addr string) (net.Conn, error)
+
+// Use the given password for authentication.
+func WithPassword(password string) SshOption {
+	return func(t *sshTarget) {
+		t.Password = password
+	}
+}
+
+// Use the given private key for authentication.
+func WithPrivateKey(key []byte) SshOption {
+	return func(t *sshTarget) {
+		t.key = key
+	}
+}
+
+// Connect to the target through the given jump host (like OpenSSH's ProxyJump
+// option). If given multiple times, the connections are tunneled through the
+// jump hosts in the order given. The address has the same form as the one of
+// the target. Jump hosts use the private key, host key verification and SSH
+// config settings of the target unless overridden by the given options. Jump
+// hosts configured for a jump host itself are ignored.
+func WithJumpHost(addr string, opts ...SshOption) SshOption {
+	return func(t *sshTarget) {
+		t.jumps = append(t.jumps, jumpHost(addr, opts...))
+	}
+}
+
+func jumpHost(addr string, opts ...SshOption) func(*sshTarget) (*sshTarget, error) {
+	return func(parent *sshTarget) (*sshTarget, error) {
+		inherited := []SshOption{func(hop *sshTarget) {
+			hop.isJumpHost = true
+			hop.key = parent.key
+			hop.knownHosts = parent.knownHosts
+			hop.hostKeyPolicy = parent.hostKeyPolicy
+			hop.configFile = parent.configFile
+			hop.noConfig = parent.noConfig
+		}}
+		return NewSshTarget(addr, append(inherited, opts...)...)
+	}
+}
+
+// Use the given dialer to connect to the target (or the first jump host).
+func WithDialer(d Dialer) SshOption {
+	return func(t *sshTarget) {
+		t.dial = d
+	}
+}
+
+// Connect to the target (or the first jump host) using the standard input and
+// output of the given command (like OpenSSH's ProxyCommand option). The
+// tokens %h and %p are replaced by host and port.
+func WithProxyCommand(command string) SshOption {
+	return WithDialer(func(network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		cmd := strings.NewReplacer("%h", host, "%p", port, "%%", "%").Replace(command)
+		return dialCommand(cmd, addr)
+	})
+}
+
+func dialCommand(command, addr string) (net.Conn, error) {
+	c := exec.Command("/bin/sh", "-c", command)
+	c.Stderr = os.Stderr
+	in, err := c.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	return &commandConn{cmd: c, in: in, out: out, addr: addr}, nil
+}
+
+// A connection using the standard input and output of a local command.
+type commandConn struct {
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	out  io.Reader
+	addr string
+}
+
+func (c *commandConn) Read(b []byte) (int, error)  { return c.out.Read(b) }
+func (c *commandConn) Write(b []byte) (int, error) { return c.in.Write(b) }
+
+func (c *commandConn) Close() error {
+	c.in.Close()
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr  { return commandAddr("local") }
+func (c *commandConn) RemoteAddr() net.Addr { return commandAddr(c.addr) }
+
+// Deadlines are not supported by command connections.
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type commandAddr string
+
+func (a commandAddr) Network() string { return "command" }
+func (a commandAddr) String() string  { return string(a) }
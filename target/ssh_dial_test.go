@@ -0,0 +1,83 @@
+package target
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSshJumpHosts(t *testing.T) {
+	s := newTestSshServer(t)
+	defer s.Close()
+	first := newTestSshServer(t)
+	defer first.Close()
+	second := newTestSshServer(t)
+	defer second.Close()
+
+	out, e := runTestCommand(s.Address("root"),
+		WithHostKeyPolicy(HostKeyInsecure),
+		WithJumpHost(first.Address("jump"), WithPassword("secret")),
+		WithJumpHost(second.Address("jump"), WithPassword("secret")),
+	)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if out != "echo hello" {
+		t.Errorf("expected output %q, got %q", "echo hello", out)
+	}
+	if v := strings.Join(first.Forwards(), ","); v != second.addr {
+		t.Errorf("expected first jump host to forward to %q, got %q", second.addr, v)
+	}
+	if v := strings.Join(second.Forwards(), ","); v != s.addr {
+		t.Errorf("expected second jump host to forward to %q, got %q", s.addr, v)
+	}
+	if v := strings.Join(s.Commands(), ","); v != "echo hello" {
+		t.Errorf("expected target to execute %q, got %q", "echo hello", v)
+	}
+}
+
+func TestSshJumpHostFailing(t *testing.T) {
+	s := newTestSshServer(t)
+	defer s.Close()
+	jump := newTestSshServer(t)
+	defer jump.Close()
+
+	_, e := runTestCommand(s.Address("root"),
+		WithHostKeyPolicy(HostKeyInsecure),
+		WithJumpHost(jump.Address("jump"), WithPassword("wrong")),
+	)
+	if e == nil || !strings.HasPrefix(e.Error(), "connecting to jump host 127.0.0.1:") {
+		t.Errorf("expected error connecting to jump host, got %v", e)
+	}
+}
+
+func TestSshDialer(t *testing.T) {
+	s := newTestSshServer(t)
+	defer s.Close()
+
+	dialed := []string{}
+	dialer := func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return net.Dial(network, addr)
+	}
+	if _, e := runTestCommand(s.Address("root"), WithHostKeyPolicy(HostKeyInsecure), WithDialer(dialer)); e != nil {
+		t.Fatal(e)
+	}
+	if v := strings.Join(dialed, ","); v != s.addr {
+		t.Errorf("expected dialer to be used for %q, got %q", s.addr, v)
+	}
+}
+
+func TestSshProxyCommand(t *testing.T) {
+	s := newTestSshServer(t)
+	defer s.Close()
+
+	proxy := `exec bash -c 'exec 3<>/dev/tcp/%h/%p; cat <&3 & cat >&3'`
+	out, e := runTestCommand(s.Address("root"), WithHostKeyPolicy(HostKeyInsecure), WithProxyCommand(proxy))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if out != "echo hello" {
+		t.Errorf("expected output %q, got %q", "echo hello", out)
+	}
+}
@@ -0,0 +1,200 @@
+package target
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Options are used to configure SSH targets.
+type SshOption func(*sshTarget)
+
+// The host key policy defines how host keys of SSH targets are verified.
+type HostKeyPolicy int
+
+const (
+	// Only hosts with a known key are accepted (the default).
+	HostKeyStrict HostKeyPolicy = iota
+	// Keys of unknown hosts are accepted and added to the known hosts file.
+	// Hosts with a different key than the known one are still rejected.
+	HostKeyTOFU
+	// Host keys are not verified at all. This should only be used for testing.
+	HostKeyInsecure
+)
+
+// Verify host keys against the given known hosts file instead of
+// ~/.ssh/known_hosts.
+func WithKnownHostsFile(path string) SshOption {
+	return func(t *sshTarget) {
+		t.knownHosts = path
+	}
+}
+
+// Only accept the given host key. The known hosts file is not used.
+func WithHostKey(key ssh.PublicKey) SshOption {
+	return func(t *sshTarget) {
+		t.hostKey = key
+	}
+}
+
+// Set the policy used to verify host keys.
+func WithHostKeyPolicy(p HostKeyPolicy) SshOption {
+	return func(t *sshTarget) {
+		t.hostKeyPolicy = p
+	}
+}
+
+// Error returned if the key of a host is either unknown or differs from the
+// known one.
+type HostKeyError struct {
+	Host string                // Address of the host as dialed.
+	Key  ssh.PublicKey         // Key presented by the host.
+	Want []knownhosts.KnownKey // Known keys of the host (empty if unknown).
+}
+
+func (e *HostKeyError) Error() string {
+	fp := ssh.FingerprintSHA256(e.Key)
+	if len(e.Want) == 0 {
+		return fmt.Sprintf("host key of %s is unknown (%s %s)", e.Host, e.Key.Type(), fp)
+	}
+	if w := e.Want[0]; w.Filename != "" {
+		return fmt.Sprintf("host key mismatch for %s: got %s %s, known key in %s:%d", e.Host, e.Key.Type(), fp, w.Filename, w.Line)
+	}
+	return fmt.Sprintf("host key mismatch for %s: got %s %s, expected %s", e.Host, e.Key.Type(), fp, ssh.FingerprintSHA256(e.Want[0].Key))
+}
+
+// Whether the host is not known at all (in contrast to a key mismatch).
+func (e *HostKeyError) Unknown() bool {
+	return len(e.Want) == 0
+}
+
+// Returns the host key algorithms to be negotiated with the given host, nil
+// if any algorithm can be used.
+type hostKeyAlgorithms func(host string, remote net.Addr) []string
+
+func (target *sshTarget) hostKeyCallback() (ssh.HostKeyCallback, hostKeyAlgorithms, error) {
+	switch {
+	case target.hostKeyPolicy == HostKeyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	case target.hostKey != nil:
+		fixed := ssh.FixedHostKey(target.hostKey)
+		return func(host string, remote net.Addr, key ssh.PublicKey) error {
+				if err := fixed(host, remote, key); err != nil {
+					return &HostKeyError{Host: host, Key: key, Want: []knownhosts.KnownKey{{Key: target.hostKey}}}
+				}
+				return nil
+			}, func(string, net.Addr) []string {
+				return keyAlgorithms([]ssh.PublicKey{target.hostKey})
+			}, nil
+	}
+
+	path := target.knownHosts
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, err
+		}
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	if target.hostKeyPolicy == HostKeyTOFU {
+		if err := touchKnownHosts(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	cb, err := knownhosts.New(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading known hosts file: %s", err)
+	}
+	return func(host string, remote net.Addr, key ssh.PublicKey) error {
+		err := cb(host, remote, key)
+		ke, ok := err.(*knownhosts.KeyError)
+		if !ok {
+			return err
+		}
+		if len(ke.Want) == 0 && target.hostKeyPolicy == HostKeyTOFU {
+			return addKnownHost(path, host, key)
+		}
+		return &HostKeyError{Host: host, Key: key, Want: ke.Want}
+	}, knownKeyAlgorithms(cb), nil
+}
+
+// A key no host has, used to look up the known keys of a host.
+var unknownHostKey ssh.PublicKey
+
+func init() {
+	var err error
+	if unknownHostKey, err = ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize))); err != nil {
+		panic(err)
+	}
+}
+
+// Like OpenSSH, only the algorithms of the keys known for a host are used, so
+// that a host offering a key of another type first is not rejected.
+func knownKeyAlgorithms(cb ssh.HostKeyCallback) hostKeyAlgorithms {
+	return func(host string, remote net.Addr) []string {
+		ke, ok := cb(host, remote, unknownHostKey).(*knownhosts.KeyError)
+		if !ok {
+			return nil
+		}
+		keys := []ssh.PublicKey{}
+		for _, k := range ke.Want {
+			keys = append(keys, k.Key)
+		}
+		return keyAlgorithms(keys)
+	}
+}
+
+// The algorithms usable with the given keys (RSA keys are used with SHA-2
+// signatures if possible).
+func keyAlgorithms(keys []ssh.PublicKey) (algos []string) {
+	seen := map[string]struct{}{}
+	for _, k := range keys {
+		list := []string{k.Type()}
+		if k.Type() == ssh.KeyAlgoRSA {
+			list = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, a := range list {
+			if _, ok := seen[a]; !ok {
+				seen[a] = struct{}{}
+				algos = append(algos, a)
+			}
+		}
+	}
+	return algos
+}
+
+// Serializes writes to known hosts files of targets connecting concurrently.
+var knownHostsMutex sync.Mutex
+
+func touchKnownHosts(path string) error {
+	knownHostsMutex.Lock()
+	defer knownHostsMutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func addKnownHost(path, host string, key ssh.PublicKey) error {
+	knownHostsMutex.Lock()
+	defer knownHostsMutex.Unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(host)}, key)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,177 @@
+package target
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func runTestCommand(addr string, opts ...SshOption) (string, error) {
+	t, e := NewSshTarget(addr, opts...)
+	if e != nil {
+		return "", e
+	}
+	t.Password = "secret"
+	defer t.Reset()
+	c, e := t.Command("echo hello")
+	if e != nil {
+		return "", e
+	}
+	buf := &bytes.Buffer{}
+	c.SetStdout(buf)
+	e = c.Run()
+	return strings.TrimSpace(buf.String()), e
+}
+
+func TestSshHostKeyVerification(t *testing.T) {
+	s := newTestSshServer(t)
+	defer s.Close()
+	other := newTestSshServer(t)
+	defer other.Close()
+
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	known := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, s.hostKey.PublicKey())
+	if e := ioutil.WriteFile(known, []byte(line+"\n"), 0600); e != nil {
+		t.Fatal(e)
+	}
+	wrong := filepath.Join(dir, "wrong_hosts")
+	line = knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, other.hostKey.PublicKey())
+	if e := ioutil.WriteFile(wrong, []byte(line+"\n"), 0600); e != nil {
+		t.Fatal(e)
+	}
+	if e := ioutil.WriteFile(filepath.Join(dir, "empty"), nil, 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	tests := []struct {
+		name     string
+		opts     []SshOption
+		mismatch bool
+		unknown  bool
+	}{
+		{"known", []SshOption{WithKnownHostsFile(known)}, false, false},
+		{"mismatch", []SshOption{WithKnownHostsFile(wrong)}, true, false},
+		{"mismatch tofu", []SshOption{WithKnownHostsFile(wrong), WithHostKeyPolicy(HostKeyTOFU)}, true, false},
+		{"unknown", []SshOption{WithKnownHostsFile(filepath.Join(dir, "empty"))}, false, true},
+		{"insecure", []SshOption{WithKnownHostsFile(wrong), WithHostKeyPolicy(HostKeyInsecure)}, false, false},
+		{"fixed", []SshOption{WithHostKey(s.hostKey.PublicKey())}, false, false},
+		{"fixed mismatch", []SshOption{WithHostKey(other.hostKey.PublicKey())}, true, false},
+	}
+	for _, tc := range tests {
+		out, e := runTestCommand(s.Address("root"), tc.opts...)
+		var hke *HostKeyError
+		switch {
+		case tc.mismatch || tc.unknown:
+			if !errors.As(e, &hke) {
+				t.Errorf("%s: expected host key error, got %v", tc.name, e)
+			} else if hke.Unknown() != tc.unknown {
+				t.Errorf("%s: expected unknown to be %t, got %t", tc.name, tc.unknown, hke.Unknown())
+			}
+		case e != nil:
+			t.Errorf("%s: expected no error, got %s", tc.name, e)
+		case out != "echo hello":
+			t.Errorf("%s: expected output %q, got %q", tc.name, "echo hello", out)
+		}
+	}
+}
+
+func TestSshHostKeyTOFU(t *testing.T) {
+	s := newTestSshServer(t)
+	defer s.Close()
+
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	known := filepath.Join(dir, "ssh", "known_hosts")
+
+	if _, e := runTestCommand(s.Address("root"), WithKnownHostsFile(known), WithHostKeyPolicy(HostKeyTOFU)); e != nil {
+		t.Fatalf("expected first connection to succeed, got %s", e)
+	}
+	b, e := ioutil.ReadFile(known)
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, hosts, key, _, _, e := ssh.ParseKnownHosts(b)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(hosts) != 1 || hosts[0] != knownhosts.Normalize(s.addr) {
+		t.Errorf("expected hosts to be [%s], got %v", knownhosts.Normalize(s.addr), hosts)
+	}
+	if !bytes.Equal(key.Marshal(), s.hostKey.PublicKey().Marshal()) {
+		t.Errorf("expected the server's key to be written to the known hosts file")
+	}
+	// Now the key is known and strict verification succeeds.
+	if _, e := runTestCommand(s.Address("root"), WithKnownHostsFile(known)); e != nil {
+		t.Errorf("expected strict verification to succeed, got %s", e)
+	}
+}
+
+func TestSshHostKeyAlgorithms(t *testing.T) {
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	ecdsaKey, e := ssh.NewSignerFromKey(key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// The client prefers ecdsa keys, but only the ed25519 key is known.
+	s := newTestSshServerAt(t, "127.0.0.1:0", ecdsaKey)
+	defer s.Close()
+
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	known := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, s.hostKey.PublicKey())
+	if e := ioutil.WriteFile(known, []byte(line+"\n"), 0600); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := runTestCommand(s.Address("root"), WithKnownHostsFile(known)); e != nil {
+		t.Errorf("expected the known ed25519 key to be used, got %s", e)
+	}
+	if _, e := runTestCommand(s.Address("root"), WithHostKey(s.hostKey.PublicKey())); e != nil {
+		t.Errorf("expected the given ed25519 key to be used, got %s", e)
+	}
+
+	tests := []struct {
+		Type     string
+		Expected string
+	}{
+		{ssh.KeyAlgoED25519, "ssh-ed25519"},
+		{ssh.KeyAlgoRSA, "rsa-sha2-512,rsa-sha2-256,ssh-rsa"},
+	}
+	for _, tc := range tests {
+		if v := strings.Join(keyAlgorithms([]ssh.PublicKey{typedKey(tc.Type)}), ","); v != tc.Expected {
+			t.Errorf("expected algorithms of %s keys to be %q, got %q", tc.Type, tc.Expected, v)
+		}
+	}
+}
+
+// A public key only used for its type.
+type typedKey string
+
+func (k typedKey) Type() string                                 { return string(k) }
+func (k typedKey) Marshal() []byte                              { return nil }
+func (k typedKey) Verify(data []byte, sig *ssh.Signature) error { return nil }
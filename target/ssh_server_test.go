@@ -0,0 +1,215 @@
+package target
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A minimal in-process SSH server used to test the SSH target. It accepts the
+// password "secret" as well as any public key and answers every exec request with the command itself
+// on stdout. Forwarding of TCP connections is supported, so that the server
+// can be used as a jump host.
+type testSshServer struct {
+	addr     string
+	hostKey  ssh.Signer
+	listener net.Listener
+
+	mutex      sync.Mutex
+	commands   []string
+	forwards   []string
+	keepAlives int
+	conns      []ssh.Conn
+}
+
+func newTestSshServer(t *testing.T) *testSshServer {
+	return newTestSshServerAt(t, "127.0.0.1:0")
+}
+
+// Start a test server on the given address (e.g. to simulate a host coming
+// back after a reboot). The extra host keys are offered in addition to the
+// server's ed25519 key.
+func newTestSshServerAt(t *testing.T, addr string, extraKeys ...ssh.Signer) *testSshServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSshServer{addr: l.Addr().String(), hostKey: signer, listener: l}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if string(pass) != "secret" {
+				return nil, fmt.Errorf("wrong password for %s", c.User())
+			}
+			return nil, nil
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	for _, k := range extraKeys {
+		config.AddHostKey(k)
+	}
+	go s.serve(config)
+	return s
+}
+
+// Stop accepting connections and drop the open ones.
+func (s *testSshServer) Close() error {
+	err := s.listener.Close()
+	s.DropConnections()
+	return err
+}
+
+func (s *testSshServer) DropConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testSshServer) KeepAlives() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.keepAlives
+}
+
+// The address of the server for the given user.
+func (s *testSshServer) Address(user string) string {
+	return user + "@" + s.addr
+}
+
+func (s *testSshServer) Commands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func (s *testSshServer) Forwards() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.forwards...)
+}
+
+func (s *testSshServer) serve(config *ssh.ServerConfig) {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(c, config)
+	}
+}
+
+func (s *testSshServer) handle(c net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		c.Close()
+		return
+	}
+	s.mutex.Lock()
+	s.conns = append(s.conns, conn)
+	s.mutex.Unlock()
+	go func() {
+		for r := range reqs {
+			if r.Type == "keepalive@openssh.com" {
+				s.mutex.Lock()
+				s.keepAlives++
+				s.mutex.Unlock()
+			}
+			if r.WantReply {
+				r.Reply(false, nil)
+			}
+		}
+	}()
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			ch, requests, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go s.session(ch, requests)
+		case "direct-tcpip":
+			go s.forward(nc)
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func (s *testSshServer) forward(nc ssh.NewChannel) {
+	var payload struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	addr := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, requests, err := nc.Accept()
+	if err != nil {
+		c.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	s.mutex.Lock()
+	s.forwards = append(s.forwards, addr)
+	s.mutex.Unlock()
+	go func() {
+		io.Copy(c, ch)
+		c.Close()
+	}()
+	io.Copy(ch, c)
+	ch.Close()
+}
+
+func (s *testSshServer) session(ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+	for r := range requests {
+		if r.Type != "exec" {
+			r.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(r.Payload, &payload); err != nil {
+			r.Reply(false, nil)
+			continue
+		}
+		r.Reply(true, nil)
+		s.mutex.Lock()
+		s.commands = append(s.commands, payload.Command)
+		s.mutex.Unlock()
+		fmt.Fprintln(ch, payload.Command)
+		status := make([]byte, 4)
+		binary.BigEndian.PutUint32(status, 0)
+		ch.SendRequest("exit-status", false, status)
+		return
+	}
+}
@@ -19,6 +19,40 @@ type Task interface {
 	Commands() ([]cmd.Command, error)
 }
 
+// Tasks with commands to run if any command of the task fails implement the
+// FailureHandler interface. The commands are run after the commands executed
+// in the same build were undone (see cmd.Undoer).
+type FailureHandler interface {
+	FailureCommands() ([]cmd.Command, error)
+}
+
+// Add commands run if any command of the given task fails (see
+// FailureHandler). Tasks not created using NewTask are wrapped.
+func OnFailure(t Task, cmds ...interface{}) Task {
+	if tt, ok := t.(*task); ok {
+		tt.onFailure = append(tt.onFailure, failureCommands(cmds)...)
+		return tt
+	}
+	return &failureTask{Task: t, onFailure: failureCommands(cmds)}
+}
+
+type failureTask struct {
+	Task
+	onFailure []*commandWrapper
+}
+
+func (t *failureTask) FailureCommands() (cmds []cmd.Command, e error) {
+	if h, ok := t.Task.(FailureHandler); ok {
+		if cmds, e = h.FailureCommands(); e != nil {
+			return nil, e
+		}
+	}
+	for _, c := range t.onFailure {
+		cmds = append(cmds, c.command)
+	}
+	return cmds, nil
+}
+
 // Create a task. This is available to provide maximum flexibility, but
 // shouldn't be required very often. The resulting task can be registered to an
 // package using the AddTask method.
@@ -27,7 +61,8 @@ func NewTask() Task {
 }
 
 type task struct {
-	commands []*commandWrapper
+	commands  []*commandWrapper
+	onFailure []*commandWrapper // run if a command of the task fails
 
 	name        string   // Name of the compilable.
 	taskBuilder Template // only used for rendering templates TODO(gf): rename
@@ -66,6 +101,27 @@ func (task *task) Add(cmds ...interface{}) Task {
 	return task
 }
 
+func (task *task) FailureCommands() (cmds []cmd.Command, e error) {
+	for _, c := range task.onFailure {
+		cmds = append(cmds, c.command)
+	}
+	return cmds, nil
+}
+
+func failureCommands(cmds []interface{}) (list []*commandWrapper) {
+	for _, c := range cmds {
+		switch t := c.(type) {
+		case string:
+			list = append(list, &commandWrapper{command: &stringCommand{cmd: t}})
+		case cmd.Command:
+			list = append(list, &commandWrapper{command: t})
+		default:
+			panic(fmt.Sprintf("type %T not supported!", t))
+		}
+	}
+	return list
+}
+
 func (task *task) validate() error {
 	if !task.validated {
 		if task.taskBuilder == nil {
@@ -99,10 +155,22 @@ func (task *task) addCommand(c cmd.Command) {
 }
 
 func (task *task) Compile() (e error) {
+	return task.compile(nil)
+}
+
+// The messages are created using the given function, so that they are
+// published to the events of the build rendering the task (or the default
+// events if nil).
+func (task *task) compile(newMessage func(key, taskName string) *pubsub.Message) (e error) {
 	if task.compiled {
 		return nil
 	}
-	m := message(pubsub.MessageTasksPrecompile, "", task.name)
+	if newMessage == nil {
+		newMessage = func(key, taskName string) *pubsub.Message {
+			return message(key, "", taskName)
+		}
+	}
+	m := newMessage(pubsub.MessageTasksPrecompile, task.name)
 	m.Publish("started")
 	defer func() {
 		if r := recover(); r != nil {
@@ -2,6 +2,10 @@ package urknall
 
 import (
 	"testing"
+
+	"github.com/dynport/urknall/cmd"
+	"github.com/dynport/urknall/pubsub"
+	"github.com/dynport/urknall/target"
 )
 
 type vers struct {
@@ -65,3 +69,74 @@ func TestInvalidTaskImpl(t *testing.T) {
 		t.Errorf("expected command %d to be %q, got %q", 1, "echo 1.3", cmds[1])
 	}
 }
+
+func TestTaskCompileMessages(t *testing.T) {
+	tpl := TemplateFunc(func(p Package) {
+		p.AddTask("base", NewTask().Add("echo 1"))
+	})
+	defaults := 0
+	unsubscribe := pubsub.DefaultEvents().Subscribe(pubsub.SinkFunc(func(m *pubsub.Message) {
+		if m.Key == pubsub.MessageTasksPrecompile+".finished" {
+			defaults++
+		}
+	}))
+	defer unsubscribe()
+
+	for _, name := range []string{"a", "b"} {
+		events := pubsub.NewEvents()
+		hosts := []string{}
+		events.Subscribe(pubsub.SinkFunc(func(m *pubsub.Message) {
+			if m.Key == pubsub.MessageTasksPrecompile+".finished" {
+				hosts = append(hosts, m.Hostname)
+			}
+		}))
+		b := &Build{Target: &namedTarget{Target: target.NewLocalTarget(), name: name}, Template: tpl, State: NewMemoryStateStore(), Events: events}
+		if _, err := b.Plan(); err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != 1 || hosts[0] != name {
+			t.Errorf("expected precompile message of build %q, got %v", name, hosts)
+		}
+	}
+	if defaults != 0 {
+		t.Errorf("expected no precompile messages on the default events, got %d", defaults)
+	}
+}
+
+// A task implemented outside of urknall.
+type externalTask struct {
+	cmds []cmd.Command
+}
+
+func (t *externalTask) Add(cmds ...interface{}) Task {
+	for _, c := range cmds {
+		t.cmds = append(t.cmds, &stringCommand{cmd: c.(string)})
+	}
+	return t
+}
+
+func (t *externalTask) Commands() ([]cmd.Command, error) {
+	return t.cmds, nil
+}
+
+func TestTaskOnFailure(t *testing.T) {
+	var _ Task = &externalTask{}
+
+	pkg := &packageImpl{}
+	pkg.AddTask("internal", OnFailure(NewTask().Add("echo 1"), "echo failed"))
+	pkg.AddTask("external", OnFailure((&externalTask{}).Add("echo 2"), "echo failed", "echo again"))
+	pkg.AddTask("plain", (&externalTask{}).Add("echo 3"))
+
+	for i, ex := range []int{1, 2, 0} {
+		tsk := pkg.tasks[i]
+		if len(tsk.commands) != 1 {
+			t.Errorf("expected task %q to have %d commands, got %d", tsk.name, 1, len(tsk.commands))
+		}
+		if v := len(tsk.onFailure); v != ex {
+			t.Errorf("expected task %q to have %d failure commands, got %d", tsk.name, ex, v)
+		}
+	}
+	if v := pkg.tasks[1].onFailure[1].command.Shell(); v != "echo again" {
+		t.Errorf("expected failure command %q, got %q", "echo again", v)
+	}
+}
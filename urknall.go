@@ -10,7 +10,11 @@ import (
 )
 
 // OpenLogger creates a logging facility for urknall using the given writer for
-// output. Note that the resource must be closed!
-func OpenLogger(w io.Writer) io.Closer {
-	return pubsub.OpenLogger(w)
+// output. Note that the resource must be closed! Builds don't write to the
+// console themselves, the commands and their output are only shown by loggers.
+//
+// The output is colourised for terminals by default. Use the
+// pubsub.WithJSONLines option to write every message as a line of JSON.
+func OpenLogger(w io.Writer, opts ...pubsub.LoggerOption) io.Closer {
+	return pubsub.OpenLogger(w, opts...)
 }
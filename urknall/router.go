@@ -7,5 +7,9 @@ func router() *cli.Router {
 	router.Register("init", &initProject{}, "Initialize a basic urknall project.")
 	router.Register("templates/add", &templatesAdd{}, "Add templates to project.")
 	router.Register("templates/list", &templatesList{}, "List all available templates.")
+	router.Register("state/show", &stateShow{}, "Show the state of the tasks executed on a host.")
+	router.Register("state/invalidate", &stateInvalidate{}, "Force execution of a task's commands with the next build.")
+	router.Register("state/logs", &stateLogs{}, "Show the logs of the last runs of a task.")
+	router.Register("state/prune", &statePrune{}, "Remove the state of all tasks not given. Orphaned tasks can't be found without the template, use urknall.Prune in the project's binary for that.")
 	return router
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/dynport/urknall"
+)
+
+// Open the target for the given host and the store its state is kept in. The
+// state is read from the host itself, unless a local state directory is given.
+func openState(host, password, dir string) (urknall.Target, urknall.StateStore, error) {
+	var t urknall.Target
+	var err error
+	switch {
+	case host == "local":
+		t, err = urknall.NewLocalTarget()
+	case password != "":
+		t, err = urknall.NewSshTargetWithPassword(host, password)
+	default:
+		t, err = urknall.NewSshTarget(host)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if dir != "" {
+		return t, urknall.NewLocalStateStore(dir), nil
+	}
+	return t, urknall.NewTargetStateStore(), nil
+}
+
+// The first line of a command's shell code.
+func commandSummary(content string) string {
+	if i := strings.Index(content, "\n"); i >= 0 {
+		return content[:i] + " ..."
+	}
+	return content
+}
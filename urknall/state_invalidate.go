@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dynport/urknall"
+)
+
+type stateInvalidate struct {
+	Password string `cli:"opt --password desc='password used to connect to the host'"`
+	StateDir string `cli:"opt --state-dir desc='use the state of the given local directory instead of the host'"`
+
+	Host string `cli:"arg required desc='host to use ([user@]host[:port] or local)'"`
+	Ref  string `cli:"arg required desc='task and optional command index (<task>[.<index>]) to execute again'"`
+}
+
+func (inv *stateInvalidate) Run() error {
+	t, store, e := openState(inv.Host, inv.Password, inv.StateDir)
+	if e != nil {
+		return e
+	}
+	state, e := store.ReadState(t)
+	if e != nil {
+		return e
+	}
+	task, idx, e := urknall.ParseTaskRef(inv.Ref, state)
+	if e != nil {
+		return e
+	}
+	if e = store.Invalidate(t, task, idx); e != nil {
+		return e
+	}
+	fmt.Printf("invalidated task %q starting with command %d\n", task, idx)
+	return nil
+}
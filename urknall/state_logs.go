@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dynport/urknall"
+)
+
+type stateLogs struct {
+	Password string `cli:"opt --password desc='password used to connect to the host'"`
+	StateDir string `cli:"opt --state-dir desc='read the logs from the given local directory instead of the host'"`
+	Runs     int    `cli:"opt -n --runs default=1 desc='number of runs to show the logs of (all if 0)'"`
+	Stream   string `cli:"opt -s --stream desc='only show lines of the given stream (stdout or stderr)'"`
+
+	Host string `cli:"arg required desc='host to inspect ([user@]host[:port] or local)'"`
+	Task string `cli:"arg required desc='task to show the logs of'"`
+}
+
+func (logs *stateLogs) Run() error {
+	t, store, e := openState(logs.Host, logs.Password, logs.StateDir)
+	if e != nil {
+		return e
+	}
+	streams := []string{}
+	if logs.Stream != "" {
+		streams = append(streams, logs.Stream)
+	}
+	lines, e := urknall.ReadLogs(t, store, logs.Task, logs.Runs, streams...)
+	if e != nil {
+		return e
+	}
+	for _, l := range lines {
+		fmt.Println(l.String())
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The urknall binary doesn't know the templates of a project, so it can't find
+// orphaned tasks by itself: all tasks not given are removed, including those
+// still produced by the template (which are executed again with the next
+// build). Orphaned tasks are found by the project's own binary using
+// urknall.Prune (the prune argument of projects created with init).
+type statePrune struct {
+	Password string `cli:"opt --password desc='password used to connect to the host'"`
+	StateDir string `cli:"opt --state-dir desc='use the state of the given local directory instead of the host'"`
+	KeepFile string `cli:"opt -f --keep-file desc='file with the names of the tasks to keep (one per line)'"`
+	DryRun   bool   `cli:"opt -n --dry-run desc='only print the tasks that would be removed'"`
+
+	Host string   `cli:"arg required desc='host to use ([user@]host[:port] or local)'"`
+	Keep []string `cli:"arg desc='names of the tasks to keep'"`
+}
+
+func (prune *statePrune) Run() error {
+	keep := map[string]struct{}{}
+	for _, name := range prune.Keep {
+		keep[name] = struct{}{}
+	}
+	if prune.KeepFile != "" {
+		f, e := os.Open(prune.KeepFile)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if name := strings.TrimSpace(scanner.Text()); name != "" {
+				keep[name] = struct{}{}
+			}
+		}
+		if e = scanner.Err(); e != nil {
+			return e
+		}
+	}
+	// Without any task to keep all state would be removed, which is most likely
+	// not what was intended.
+	if len(keep) == 0 {
+		return fmt.Errorf("no tasks to keep given (use urknall.Prune in the project's binary to remove orphaned tasks)")
+	}
+
+	t, store, e := openState(prune.Host, prune.Password, prune.StateDir)
+	if e != nil {
+		return e
+	}
+	state, e := store.ReadState(t)
+	if e != nil {
+		return e
+	}
+	orphaned := []string{}
+	for name := range state {
+		if _, ok := keep[name]; !ok {
+			orphaned = append(orphaned, name)
+		}
+	}
+	sort.Strings(orphaned)
+	for _, name := range orphaned {
+		if prune.DryRun {
+			fmt.Printf("would remove task %q\n", name)
+			continue
+		}
+		if e = store.Remove(t, name); e != nil {
+			return e
+		}
+		fmt.Printf("removed task %q\n", name)
+	}
+	return nil
+}
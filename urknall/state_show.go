@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+type stateShow struct {
+	Password string `cli:"opt --password desc='password used to connect to the host'"`
+	StateDir string `cli:"opt --state-dir desc='read the state from the given local directory instead of the host'"`
+
+	Host string `cli:"arg required desc='host to inspect ([user@]host[:port] or local)'"`
+}
+
+func (show *stateShow) Run() error {
+	t, store, e := openState(show.Host, show.Password, show.StateDir)
+	if e != nil {
+		return e
+	}
+	state, e := store.ReadState(t)
+	if e != nil {
+		return e
+	}
+	names := []string{}
+	for name := range state {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		ts := state[name]
+		fmt.Fprintf(w, "%s\tlast run: %s\tcommands: %d\n", ts.Name, ts.LastRun, len(ts.Checksums))
+		for i, cs := range ts.Checksums {
+			fmt.Fprintf(w, "  %d\t%.12s\t%s\n", i, cs, commandSummary(ts.Content[cs]))
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,310 @@
+// Helpers for testing templates.
+//
+// The FakeTarget records all commands executed by a build without running
+// anything. The state of executed commands is kept in memory, so that the
+// caching behaviour of templates can be tested as well.
+package urknalltest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dynport/urknall"
+	"github.com/dynport/urknall/target"
+)
+
+// Create a fake target with the given name. Commands are executed as root.
+func NewFakeTarget(name string) *FakeTarget {
+	return &FakeTarget{Name: name, UserName: "root", StateStore: urknall.NewMemoryStateStore()}
+}
+
+// A fake target records the commands run on it and answers them with scripted
+// responses. It implements the urknall.StateStore interface, so that builds
+// keep their state in memory.
+type FakeTarget struct {
+	Name     string
+	UserName string
+	urknall.StateStore
+
+	mutex     sync.Mutex
+	calls     []*Call
+	records   []*urknall.CommandRecord
+	responses []*Response
+	boots     int
+}
+
+// A single command run on the fake target.
+type Call struct {
+	Command string // The command as given to the target.
+	Shell   string // The command's shell code if run by a build (the command otherwise).
+	Stdin   string // Content read from standard input.
+}
+
+// A scripted response to commands matching a pattern.
+type Response struct {
+	pattern  *regexp.Regexp
+	stdout   string
+	stderr   string
+	exitCode int
+}
+
+// Write the given output to standard output.
+func (r *Response) Stdout(out string) *Response {
+	r.stdout = out
+	return r
+}
+
+// Write the given output to standard error.
+func (r *Response) Stderr(out string) *Response {
+	r.stderr = out
+	return r
+}
+
+// Exit with the given code.
+func (r *Response) Exit(code int) *Response {
+	r.exitCode = code
+	return r
+}
+
+// Script the response for commands whose shell code matches the given regular
+// expression. Responses added later take precedence. Commands without a
+// matching response succeed without output.
+func (f *FakeTarget) On(pattern string) *Response {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	r := &Response{pattern: regexp.MustCompile(pattern)}
+	f.responses = append(f.responses, r)
+	return r
+}
+
+func (f *FakeTarget) String() string {
+	return f.Name
+}
+
+func (f *FakeTarget) User() string {
+	return f.UserName
+}
+
+func (f *FakeTarget) Reset() error {
+	return nil
+}
+
+// Commands rebooting the target (like cmd.Reboot) change the boot id, so that
+// builds waiting for the target to return continue immediately.
+var (
+	bootIDRegexp = regexp.MustCompile(`^cat /proc/sys/kernel/random/boot_id$`)
+	rebootRegexp = regexp.MustCompile(`\b(reboot|shutdown -r)\b`)
+)
+
+func (f *FakeTarget) Command(cmd string) (target.ExecCommand, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	call := &Call{Command: cmd, Shell: extractShell(cmd)}
+	f.calls = append(f.calls, call)
+	var r *Response
+	for i := len(f.responses) - 1; i >= 0; i-- {
+		if f.responses[i].pattern.MatchString(call.Shell) {
+			r = f.responses[i]
+			break
+		}
+	}
+	switch {
+	case r != nil:
+	case bootIDRegexp.MatchString(call.Shell):
+		r = &Response{stdout: fmt.Sprintf("fake-boot-%d", f.boots)}
+	default:
+		r = &Response{}
+	}
+	if rebootRegexp.MatchString(call.Shell) {
+		f.boots++
+	}
+	return &fakeCommand{call: call, response: r, mutex: &f.mutex}, nil
+}
+
+// Records of the executed commands are kept before being handed to the
+// state store.
+func (f *FakeTarget) Record(t urknall.Target, r *urknall.CommandRecord) error {
+	f.mutex.Lock()
+	f.records = append(f.records, r)
+	f.mutex.Unlock()
+	return f.StateStore.Record(t, r)
+}
+
+// All commands run on the target.
+func (f *FakeTarget) Calls() []*Call {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]*Call{}, f.calls...)
+}
+
+// Shell code of all commands of the given task executed by builds (in order),
+// including failed ones.
+func (f *FakeTarget) Executed(task string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cmds := []string{}
+	for _, r := range f.records {
+		if r.Task == task {
+			cmds = append(cmds, r.Content)
+		}
+	}
+	return cmds
+}
+
+// Forget all calls and executed commands. The state is kept, so that the next
+// build only executes changed commands.
+func (f *FakeTarget) Clear() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls = nil
+	f.records = nil
+}
+
+// Fail the test unless exactly the given commands were executed for the task.
+func (f *FakeTarget) AssertExecuted(t testing.TB, task string, cmds ...string) {
+	t.Helper()
+	executed := f.Executed(task)
+	if strings.Join(executed, "\n") != strings.Join(cmds, "\n") {
+		t.Errorf("expected task %q to execute\n%s\ngot\n%s", task, formatCommands(cmds), formatCommands(executed))
+	}
+}
+
+// Fail the test if any command was executed for the task.
+func (f *FakeTarget) AssertNotExecuted(t testing.TB, task string) {
+	t.Helper()
+	if executed := f.Executed(task); len(executed) > 0 {
+		t.Errorf("expected task %q not to execute any commands, got\n%s", task, formatCommands(executed))
+	}
+}
+
+func formatCommands(cmds []string) string {
+	if len(cmds) == 0 {
+		return "  (none)"
+	}
+	lines := []string{}
+	for i, c := range cmds {
+		lines = append(lines, fmt.Sprintf("  %d: %s", i, c))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Builds wrap the shell code of commands in a script, writing the code to a
+// temporary file using a here document.
+var shellRegexp = regexp.MustCompile(`(?s)<<"UKEOF"\n(.*)\nUKEOF\n`)
+
+func extractShell(cmd string) string {
+	if m := shellRegexp.FindStringSubmatch(cmd); m != nil {
+		return m[1]
+	}
+	return cmd
+}
+
+// Error returned by commands exiting with a code other than 0.
+type ExitError struct {
+	Command string
+	Code    int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command %q exited with status %d", e.Command, e.Code)
+}
+
+func (e *ExitError) ExitStatus() int {
+	return e.Code
+}
+
+type fakeCommand struct {
+	call     *Call
+	response *Response
+	mutex    *sync.Mutex
+
+	stdin          io.Reader
+	stdout, stderr io.Writer
+	outPipe        *io.PipeWriter
+	errPipe        *io.PipeWriter
+	done           chan struct{}
+}
+
+func (c *fakeCommand) StdoutPipe() (io.Reader, error) {
+	r, w := io.Pipe()
+	c.stdout, c.outPipe = w, w
+	return r, nil
+}
+
+func (c *fakeCommand) StderrPipe() (io.Reader, error) {
+	r, w := io.Pipe()
+	c.stderr, c.errPipe = w, w
+	return r, nil
+}
+
+func (c *fakeCommand) StdinPipe() (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	c.stdin = r
+	return w, nil
+}
+
+func (c *fakeCommand) SetStdout(w io.Writer) { c.stdout = w }
+func (c *fakeCommand) SetStderr(w io.Writer) { c.stderr = w }
+func (c *fakeCommand) SetStdin(r io.Reader)  { c.stdin = r }
+
+func (c *fakeCommand) Start() error {
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		if c.stdin != nil {
+			b, _ := ioutil.ReadAll(c.stdin)
+			c.mutex.Lock()
+			c.call.Stdin = string(b)
+			c.mutex.Unlock()
+		}
+		write(c.stdout, c.response.stdout)
+		write(c.stderr, c.response.stderr)
+		if c.outPipe != nil {
+			c.outPipe.Close()
+		}
+		if c.errPipe != nil {
+			c.errPipe.Close()
+		}
+	}()
+	return nil
+}
+
+func write(w io.Writer, s string) {
+	if w == nil || s == "" {
+		return
+	}
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	io.Copy(w, bytes.NewBufferString(s))
+}
+
+func (c *fakeCommand) Wait() error {
+	if c.done == nil {
+		return fmt.Errorf("command not started")
+	}
+	<-c.done
+	if c.response.exitCode != 0 {
+		return &ExitError{Command: c.call.Shell, Code: c.response.exitCode}
+	}
+	return nil
+}
+
+// Commands finish right away, so there is nothing to kill. Builds accept
+// commands with timeouts on the fake target nonetheless.
+func (c *fakeCommand) Kill() error {
+	return nil
+}
+
+func (c *fakeCommand) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
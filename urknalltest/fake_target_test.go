@@ -0,0 +1,140 @@
+package urknalltest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dynport/urknall"
+	"github.com/dynport/urknall/cmd"
+)
+
+type shell string
+
+func (s shell) Shell() string { return string(s) }
+
+func TestFakeTarget(t *testing.T) {
+	f := NewFakeTarget("host")
+	f.On("^echo two$").Stdout("scripted")
+	cmds := []cmd.Command{shell("echo one"), shell("echo two")}
+	tpl := urknall.TemplateFunc(func(p urknall.Package) {
+		p.AddCommands("base", cmds...)
+	})
+
+	if e := urknall.Run(f, tpl); e != nil {
+		t.Fatal(e)
+	}
+	f.AssertExecuted(t, "base", "echo one", "echo two")
+
+	logs, e := urknall.ReadLogs(f, nil, "base", 1, "stdout")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(logs) != 1 || logs[0].Line != "scripted" {
+		t.Errorf("expected scripted output to be logged, got %v", logs)
+	}
+
+	// Unchanged commands are cached.
+	f.Clear()
+	if e := urknall.Run(f, tpl); e != nil {
+		t.Fatal(e)
+	}
+	f.AssertNotExecuted(t, "base")
+
+	// Changed commands are executed again, including all following ones.
+	f.Clear()
+	cmds = []cmd.Command{shell("echo 1"), shell("echo two")}
+	if e := urknall.Run(f, tpl); e != nil {
+		t.Fatal(e)
+	}
+	f.AssertExecuted(t, "base", "echo 1", "echo two")
+}
+
+func TestFakeTargetFailure(t *testing.T) {
+	f := NewFakeTarget("host")
+	f.On("fail").Stderr("boom").Exit(2)
+	tpl := urknall.TemplateFunc(func(p urknall.Package) {
+		p.AddCommands("base", shell("echo ok"), shell("fail now"), shell("echo never"))
+	})
+	e := urknall.Run(f, tpl)
+	var ee *ExitError
+	if !errors.As(e, &ee) || ee.Code != 2 {
+		t.Fatalf("expected exit error with code 2, got %v", e)
+	}
+	var be *urknall.BuildError
+	if !errors.As(e, &be) {
+		t.Fatalf("expected build error, got %T", e)
+	}
+	if be.Host != "host" || be.Task != "base" || be.Index != 1 || be.ExitCode != 2 || be.Command != "fail now" {
+		t.Errorf("unexpected build error %#v", be)
+	}
+	if v := strings.Join(be.Stderr, "\n"); v != "boom" {
+		t.Errorf("expected stderr tail %q, got %q", "boom", v)
+	}
+	if v, ex := e.Error(), `host: task "base": command 1 "fail now" failed with exit code 2`; v != ex {
+		t.Errorf("expected error %q, got %q", ex, v)
+	}
+	f.AssertExecuted(t, "base", "echo ok", "fail now")
+
+	calls := f.Calls()
+	shells := []string{}
+	for _, c := range calls {
+		shells = append(shells, c.Shell)
+	}
+	if v := strings.Join(shells, ","); v != "echo ok,fail now" {
+		t.Errorf("expected calls %q, got %q", "echo ok,fail now", v)
+	}
+}
+
+func TestFakeTargetReboot(t *testing.T) {
+	f := NewFakeTarget("host")
+	tpl := urknall.TemplateFunc(func(p urknall.Package) {
+		p.AddCommands("kernel", shell("echo before"), &cmd.Reboot{}, shell("echo after"))
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	started := time.Now()
+	e := urknall.RunContext(ctx, f, tpl, func(b *urknall.Build) {
+		b.CommandTimeout = time.Minute
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if d := time.Since(started); d > 5*time.Second {
+		t.Errorf("expected the build not to wait for the reboot, took %s", d)
+	}
+	f.AssertExecuted(t, "kernel", "echo before", (&cmd.Reboot{}).Shell(), "echo after")
+}
+
+// Records failed assertions instead of failing the test.
+type recorder struct {
+	testing.TB
+	errors   []string
+	messages []string
+}
+
+func (r *recorder) Helper() {}
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, format)
+	r.messages = append(r.messages, fmt.Sprintf(format, args...))
+}
+
+func TestFakeTargetAssertions(t *testing.T) {
+	f := NewFakeTarget("host")
+	tpl := urknall.TemplateFunc(func(p urknall.Package) {
+		p.AddCommands("base", shell("echo one"))
+	})
+	if e := urknall.Run(f, tpl); e != nil {
+		t.Fatal(e)
+	}
+	r := &recorder{}
+	f.AssertExecuted(r, "base", "echo two")
+	f.AssertNotExecuted(r, "base")
+	f.AssertNotExecuted(r, "other")
+	if len(r.errors) != 2 {
+		t.Errorf("expected %d failed assertions, got %d", 2, len(r.errors))
+	}
+}
@@ -0,0 +1,70 @@
+package urknalltest
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dynport/urknall"
+	"github.com/dynport/urknall/utils"
+)
+
+// The flag is namespaced, so that packages importing urknalltest can still
+// declare their own -update flag.
+var update = flag.Bool("urknall.update", false, "update golden files of urknall templates")
+
+// Render the template into a snapshot: the tasks with the checksums and shell
+// code of their commands. Changed checksums mean the commands are executed
+// again on all hosts.
+func Snapshot(tpl urknall.Template) (string, error) {
+	p, err := (&urknall.Build{Target: NewFakeTarget("snapshot"), Template: tpl}).Plan()
+	if err != nil {
+		return "", err
+	}
+	lines := []string{}
+	for _, t := range p.Tasks {
+		lines = append(lines, "## task "+t.Name)
+		for _, c := range t.Commands {
+			lines = append(lines, fmt.Sprintf("# %d %s", c.Index, c.Checksum), c.Content)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// Compare the template's snapshot with the given golden file and fail the
+// test on differences showing a unified diff. The golden file is written if
+// the test is run with the -urknall.update flag.
+func AssertGolden(t testing.TB, tpl urknall.Template, path string) {
+	t.Helper()
+	actual, err := Snapshot(tpl)
+	if err != nil {
+		t.Errorf("rendering template: %s", err)
+		return
+	}
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Errorf("updating golden file: %s", err)
+			return
+		}
+		if err := ioutil.WriteFile(path, []byte(actual), 0644); err != nil {
+			t.Errorf("updating golden file: %s", err)
+		}
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		t.Errorf("golden file %s does not exist (run tests with -urknall.update to create it)", path)
+		return
+	case err != nil:
+		t.Errorf("reading golden file: %s", err)
+		return
+	}
+	if expected := string(b); expected != actual {
+		t.Errorf("template differs from golden file %s (run tests with -urknall.update to accept):\n%s", path, utils.UnifiedDiff(path, "rendered", expected, actual))
+	}
+}
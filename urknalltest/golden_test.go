@@ -0,0 +1,63 @@
+package urknalltest
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dynport/urknall"
+)
+
+// Packages using urknalltest declare their own -update flag.
+var _ = flag.Bool("update", false, "update golden files")
+
+func TestUpdateFlag(t *testing.T) {
+	if flag.Lookup("urknall.update") == nil {
+		t.Errorf("expected flag %q to be registered", "urknall.update")
+	}
+}
+
+func TestAssertGolden(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "testdata", "base.golden")
+
+	content := "echo one"
+	tpl := urknall.TemplateFunc(func(p urknall.Package) {
+		p.AddCommands("base", shell(content), shell("echo two"))
+	})
+
+	r := &recorder{}
+	AssertGolden(r, tpl, path)
+	if len(r.errors) != 1 {
+		t.Errorf("expected missing golden file to fail")
+	}
+
+	*update = true
+	AssertGolden(t, tpl, path)
+	*update = false
+	b, e := ioutil.ReadFile(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if v := string(b); !strings.HasPrefix(v, "## task base\n# 0 ") || !strings.Contains(v, "\necho one\n# 1 ") {
+		t.Errorf("unexpected golden file content %q", v)
+	}
+	AssertGolden(t, tpl, path)
+
+	content = "echo 1"
+	r = &recorder{}
+	AssertGolden(r, tpl, path)
+	if len(r.errors) != 1 {
+		t.Fatalf("expected changed template to fail")
+	}
+	if msg := r.messages[0]; !strings.Contains(msg, "\n-echo one\n") || !strings.Contains(msg, "\n+echo 1\n") {
+		t.Errorf("expected diff in message, got %q", msg)
+	}
+}
@@ -3,12 +3,16 @@ package urknall
 import (
 	"crypto/sha256"
 	"fmt"
+	"strings"
 
 	"github.com/dynport/urknall/cmd"
+	"github.com/dynport/urknall/pubsub"
 )
 
-func renderTemplate(builder Template) (*packageImpl, error) {
-	p := &packageImpl{reference: builder}
+// Messages published while rendering are created using the given function
+// (published to the default events if nil).
+func renderTemplate(builder Template, message func(key, taskName string) *pubsub.Message) (*packageImpl, error) {
+	p := &packageImpl{reference: builder, secrets: templateSecrets(builder), message: message}
 	e := validateTemplate(builder)
 	if e != nil {
 		return nil, e
@@ -27,6 +31,12 @@ func commandChecksum(c cmd.Command) (string, error) {
 	if _, e := s.Write([]byte(c.Shell())); e != nil {
 		return "", e
 	}
+	// The checksums of commands run as root are kept unchanged.
+	if u := runAsUser(c); u != "" {
+		if _, e := s.Write([]byte("\x00" + u)); e != nil {
+			return "", e
+		}
+	}
 	return fmt.Sprintf("%x", s.Sum(nil)), nil
 }
 
@@ -42,3 +52,8 @@ func midTrunc(in string, l int) string {
 	}
 	return in[0:beg] + "..." + in[len(in)-end:]
 }
+
+// Quote the given string for use as a single argument in the shell.
+func shellQuote(in string) string {
+	return "'" + strings.Replace(in, "'", `'"'"'`, -1) + "'"
+}
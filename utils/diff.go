@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Maximum number of cells of the LCS table. Larger inputs are diffed as a
+// complete replacement.
+const maxDiffCells = 4 << 20
+
+const diffContext = 3
+
+// Create a diff in unified format of the given strings. An empty string is
+// returned if both are equal.
+func UnifiedDiff(fromName, toName, from, to string) string {
+	if from == to {
+		return ""
+	}
+	a, b := splitLines(from), splitLines(to)
+	ops := diffLines(a, b)
+
+	out := []string{"--- " + fromName, "+++ " + toName}
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Collect a hunk: changes closer together than twice the context are merged.
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*diffContext {
+				break
+			}
+			end = next
+		}
+		end += diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+		out = append(out, hunk(ops[start:end])...)
+		i = end
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+type diffOp struct {
+	kind       byte // ' ', '-' or '+'
+	line       string
+	aIdx, bIdx int // line numbers (starting with 1) in the from and to input
+}
+
+func hunk(ops []diffOp) []string {
+	aStart, bStart, aLen, bLen := 0, 0, 0, 0
+	lines := []string{}
+	for _, op := range ops {
+		if op.kind != '+' {
+			if aStart == 0 {
+				aStart = op.aIdx
+			}
+			aLen++
+		}
+		if op.kind != '-' {
+			if bStart == 0 {
+				bStart = op.bIdx
+			}
+			bLen++
+		}
+		lines = append(lines, string(op.kind)+op.line)
+	}
+	if aStart == 0 {
+		aStart = ops[0].aIdx - 1
+	}
+	if bStart == 0 {
+		bStart = ops[0].bIdx - 1
+	}
+	return append([]string{fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aLen, bStart, bLen)}, lines...)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// Line based diff using the longest common subsequence of both inputs.
+func diffLines(a, b []string) (ops []diffOp) {
+	n, m := len(a), len(b)
+	if n*m > maxDiffCells {
+		for i := range a {
+			ops = append(ops, diffOp{kind: '-', line: a[i], aIdx: i + 1, bIdx: 1})
+		}
+		for j := range b {
+			ops = append(ops, diffOp{kind: '+', line: b[j], aIdx: n + 1, bIdx: j + 1})
+		}
+		return ops
+	}
+
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && a[i] == b[j]:
+			ops = append(ops, diffOp{kind: ' ', line: a[i], aIdx: i + 1, bIdx: j + 1})
+			i++
+			j++
+		case j < m && (i == n || lcs[i][j+1] > lcs[i+1][j]):
+			ops = append(ops, diffOp{kind: '+', line: b[j], aIdx: i + 1, bIdx: j + 1})
+			j++
+		default:
+			ops = append(ops, diffOp{kind: '-', line: a[i], aIdx: i + 1, bIdx: j + 1})
+			i++
+		}
+	}
+	return ops
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	if v := UnifiedDiff("a", "b", "same\n", "same\n"); v != "" {
+		t.Errorf("expected empty diff for equal input, got %q", v)
+	}
+
+	from := "1\n2\n3\n4\n5\n6\n7\n8\n9\n"
+	to := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n"
+	ex := "--- a\n+++ b\n@@ -2,8 +2,9 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n 9\n+10\n"
+	if v := UnifiedDiff("a", "b", from, to); v != ex {
+		t.Errorf("expected diff to be\n%s\ngot\n%s", ex, v)
+	}
+
+	ex = "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+new\n+file\n"
+	if v := UnifiedDiff("a", "b", "", "new\nfile\n"); v != ex {
+		t.Errorf("expected diff to be\n%s\ngot\n%s", ex, v)
+	}
+
+	from = "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	to = "A\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nL\n"
+	ex = "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-a\n+A\n b\n c\n d\n@@ -9,4 +9,4 @@\n i\n j\n k\n-l\n+L\n"
+	if v := UnifiedDiff("a", "b", from, to); v != ex {
+		t.Errorf("expected diff to be\n%s\ngot\n%s", ex, v)
+	}
+}
@@ -45,3 +45,16 @@ func TestMidTruncate(t *testing.T) {
 		}
 	}
 }
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"FOO=bar":         `'FOO=bar'`,
+		"FOO=bar baz":     `'FOO=bar baz'`,
+		"FOO=it's quoted": `'FOO=it'"'"'s quoted'`,
+	}
+	for in, ex := range tests {
+		if v := shellQuote(in); v != ex {
+			t.Errorf("expected %q to be quoted as %q, got %q", in, ex, v)
+		}
+	}
+}